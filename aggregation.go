@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Aggregation is a per station aggregate selected with -aggs. Every station
+// gets its own instance of each selected aggregation, observing the readings
+// in tenths of a degree Celsius. The instances of a station are built by the
+// workers concurrently, so they must also merge the instance of another
+// worker, which is always of their own type.
+type Aggregation interface {
+	Name() string
+	Observe(tenths int)
+	Merge(other Aggregation)
+	Finalize() float64 // in degrees Celsius, or a plain number like count
+}
+
+// The aggregations -aggs can select, by name.
+var aggregations = map[string]func() Aggregation{
+	"min":   func() Aggregation { return &minAgg{v: math.MaxInt} },
+	"max":   func() Aggregation { return &maxAgg{v: math.MinInt} },
+	"mean":  func() Aggregation { return &meanAgg{} },
+	"range": func() Aggregation { return &rangeAgg{min: math.MaxInt, max: math.MinInt} },
+	"count": func() Aggregation { return &countAgg{} },
+}
+
+// RegisterAggregation makes a custom aggregation selectable by name with
+// -aggs, e.g. from an init function. It panics on a name taken already.
+func RegisterAggregation(name string, newAggregation func() Aggregation) {
+	if _, ok := aggregations[name]; ok {
+		panic("aggregation " + name + " is registered already")
+	}
+	aggregations[name] = newAggregation
+}
+
+// Parse the comma separated names of -aggs.
+func parseAggregations(v string) ([]string, error) {
+	names := strings.Split(v, ",")
+	for _, name := range names {
+		if _, ok := aggregations[name]; !ok {
+			known := slices.Sorted(maps.Keys(aggregations))
+			return nil, fmt.Errorf("unknown aggregation %q, expected one of %s", name, strings.Join(known, ", "))
+		}
+	}
+	return names, nil
+}
+
+func newAggregations(names []string) []Aggregation {
+	aggs := make([]Aggregation, len(names))
+	for i, name := range names {
+		aggs[i] = aggregations[name]()
+	}
+	return aggs
+}
+
+type minAgg struct{ v int }
+
+func (m *minAgg) Name() string            { return "min" }
+func (m *minAgg) Observe(tenths int)      { m.v = min(m.v, tenths) }
+func (m *minAgg) Merge(other Aggregation) { m.v = min(m.v, other.(*minAgg).v) }
+func (m *minAgg) Finalize() float64       { return float64(m.v) / 10 }
+
+type maxAgg struct{ v int }
+
+func (m *maxAgg) Name() string            { return "max" }
+func (m *maxAgg) Observe(tenths int)      { m.v = max(m.v, tenths) }
+func (m *maxAgg) Merge(other Aggregation) { m.v = max(m.v, other.(*maxAgg).v) }
+func (m *maxAgg) Finalize() float64       { return float64(m.v) / 10 }
+
+// The sum of tenths is exact, unlike the float sums of the default columns.
+type meanAgg struct{ sum, n int }
+
+func (m *meanAgg) Name() string       { return "mean" }
+func (m *meanAgg) Observe(tenths int) { m.sum += tenths; m.n++ }
+func (m *meanAgg) Merge(other Aggregation) {
+	o := other.(*meanAgg)
+	m.sum += o.sum
+	m.n += o.n
+}
+func (m *meanAgg) Finalize() float64 { return float64(m.sum) / float64(m.n) / 10 }
+
+type rangeAgg struct{ min, max int }
+
+func (r *rangeAgg) Name() string { return "range" }
+func (r *rangeAgg) Observe(tenths int) {
+	r.min = min(r.min, tenths)
+	r.max = max(r.max, tenths)
+}
+func (r *rangeAgg) Merge(other Aggregation) {
+	o := other.(*rangeAgg)
+	r.min = min(r.min, o.min)
+	r.max = max(r.max, o.max)
+}
+func (r *rangeAgg) Finalize() float64 { return float64(r.max-r.min) / 10 }
+
+type countAgg struct{ n int }
+
+func (c *countAgg) Name() string            { return "count" }
+func (c *countAgg) Observe(int)             { c.n++ }
+func (c *countAgg) Merge(other Aggregation) { c.n += other.(*countAgg).n }
+func (c *countAgg) Finalize() float64       { return float64(c.n) }
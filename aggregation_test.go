@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// A custom aggregation as a user would register it, max - min.
+type spanAgg struct{ lo, hi int }
+
+func (s *spanAgg) Name() string { return "span" }
+func (s *spanAgg) Observe(tenths int) {
+	s.lo = min(s.lo, tenths)
+	s.hi = max(s.hi, tenths)
+}
+func (s *spanAgg) Merge(other Aggregation) {
+	o := other.(*spanAgg)
+	s.lo = min(s.lo, o.lo)
+	s.hi = max(s.hi, o.hi)
+}
+func (s *spanAgg) Finalize() float64 { return float64(s.hi-s.lo) / 10 }
+
+func TestRegisterAggregation(t *testing.T) {
+	RegisterAggregation("span", func() Aggregation { return &spanAgg{lo: math.MaxInt, hi: math.MinInt} })
+	t.Cleanup(func() { delete(aggregations, "span") })
+
+	names, err := parseAggregations("span,range,min,max")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultArgs()
+	opts.workers, opts.aggs = 4, names
+	input := "Paris;1.0\nParis;-3.5\nOslo;2.0\n" + string(genMeasurements(100_000, []string{"Lima"}))
+	var b bytes.Buffer
+	if err := printSolutions(&b, aggregate(t, opts, strings.NewReader(input)), opts); err != nil {
+		t.Fatal(err)
+	}
+	// merged across the workers like the built in range
+	if want := "Lima=199.8/199.8/-99.9/99.9\nOslo=0.0/0.0/2.0/2.0\nParis=4.5/4.5/-3.5/1.0\n"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+
+	if _, err := parseAggregations("span,mode"); err == nil || !strings.Contains(err.Error(), "expected one of count, max, mean, min, range, span") {
+		t.Errorf("got %v for an unknown aggregation", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("registered range twice")
+		}
+	}()
+	RegisterAggregation("range", func() Aggregation { return &spanAgg{} })
+}
@@ -0,0 +1,33 @@
+package main
+
+import "unsafe"
+
+// With -name-arena the station names a parser adds to its map are copied into
+// large shared blocks instead of a string allocation each, so inputs where
+// nearly every line is a new station leave far fewer objects for the GC to
+// track. The map keys point into the blocks, so a block is never written
+// again once a name is handed out and lives for as long as any of its names
+// is still a key: the worker maps, and then the merged map of the aggregator,
+// which keeps the keys as they are. There is nothing to free by hand, the
+// blocks go with the last map holding their names.
+const nameArenaBlock = 64 * 1024
+
+type nameArena struct {
+	block []byte
+}
+
+// The name as a string backed by the arena.
+func (a *nameArena) string(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if len(b) > cap(a.block)-len(a.block) {
+		if len(b) > nameArenaBlock/4 {
+			return string(b) // would waste most of a block
+		}
+		a.block = make([]byte, 0, nameArenaBlock)
+	}
+	start := len(a.block)
+	a.block = append(a.block, b...)
+	return unsafe.String(&a.block[start], len(b))
+}
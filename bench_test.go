@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Synthetic measurements for the benchmarks: rows readings of the names
+// drawn uniformly, with values within [-99.9, 99.9], from a fixed seed.
+func genMeasurements(rows int, names []string) []byte {
+	rng := rand.New(rand.NewPCG(1, uint64(len(names))))
+	var b bytes.Buffer
+	for range rows {
+		b.WriteString(names[rng.IntN(len(names))])
+		b.WriteByte(';')
+		b.Write(strconv.AppendFloat(nil, float64(rng.IntN(1999)-999)/10, 'f', 1, 64))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// Like genMeasurements with the names drawn from a Zipf distribution, the
+// first ones far more often than the last.
+func genSkewedMeasurements(rows int, names []string) []byte {
+	rng := rand.New(rand.NewPCG(3, uint64(len(names))))
+	zipf := rand.NewZipf(rng, 1.2, 1, uint64(len(names)-1))
+	var b bytes.Buffer
+	for range rows {
+		b.WriteString(names[zipf.Uint64()])
+		b.WriteByte(';')
+		b.Write(strconv.AppendFloat(nil, float64(rng.IntN(1999)-999)/10, 'f', 1, 64))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// n distinct names of minLen to maxLen bytes, lowercase letters followed by
+// their index so they never repeat.
+func genNames(n, minLen, maxLen int) []string {
+	rng := rand.New(rand.NewPCG(2, uint64(n)))
+	names := make([]string, n)
+	for i := range names {
+		suffix := strconv.Itoa(i)
+		name := make([]byte, max(0, minLen+rng.IntN(maxLen-minLen+1)-len(suffix)))
+		for k := range name {
+			name[k] = byte('a' + rng.IntN(26))
+		}
+		names[i] = string(name) + suffix
+	}
+	return names
+}
+
+// Aggregate input with opts b.N times.
+func benchmarkAggregate(b *testing.B, opts args, input []byte) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(input)))
+	for b.Loop() {
+		agg := newAggregator(opts)
+		if err := agg.AddReader(bytes.NewReader(input)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The station lookup of the map against the alternatives in front of it,
+// across cardinalities and name lengths, on a single worker so that the
+// lookups are what is measured.
+func BenchmarkStations(b *testing.B) {
+	lookups := []struct {
+		name string
+		set  func(*args)
+	}{
+		{"map", func(*args) {}},
+		{"hot-stations", func(a *args) { a.hotStations = maxHotStations }},
+		{"name-arena", func(a *args) { a.nameArena = true }},
+	}
+	for _, stations := range []int{100, 10_000, 500_000} {
+		for _, lengths := range []struct {
+			name     string
+			min, max int
+		}{{"short", 3, 12}, {"long", 30, 100}} {
+			var input []byte
+			b.Run(fmt.Sprintf("stations=%d/names=%s", stations, lengths.name), func(b *testing.B) {
+				if input == nil {
+					input = genMeasurements(1<<20, genNames(stations, lengths.min, lengths.max))
+				}
+				for _, lookup := range lookups {
+					b.Run(lookup.name, func(b *testing.B) {
+						opts := defaultArgs()
+						opts.workers = 1
+						lookup.set(&opts)
+						benchmarkAggregate(b, opts, input)
+					})
+				}
+			})
+		}
+	}
+}
+
+// A row counter shared by the workers, added to on every row or once per
+// chunk as the parsers do.
+func BenchmarkRowCounter(b *testing.B) {
+	const workers, rowsPerChunk = 16, 300_000
+	for _, perChunk := range []bool{false, true} {
+		name := "per-row"
+		if perChunk {
+			name = "per-chunk"
+		}
+		b.Run(name, func(b *testing.B) {
+			for b.Loop() {
+				var total atomic.Int64
+				var wg sync.WaitGroup
+				for range workers {
+					wg.Go(func() {
+						var rows int64
+						for range rowsPerChunk {
+							if perChunk {
+								rows++
+							} else {
+								total.Add(1)
+							}
+						}
+						total.Add(rows)
+					})
+				}
+				wg.Wait()
+				if total.Load() != workers*rowsPerChunk {
+					b.Fatalf("counted %d rows", total.Load())
+				}
+			}
+		})
+	}
+}
+
+// Repeated small solves, whose read and worker buffers come from the pool:
+// the B/op stay far below the 4 MiB of a single buffer.
+func BenchmarkRepeatedAggregate(b *testing.B) {
+	input := genMeasurements(1000, genNames(10, 3, 12))
+	b.ReportAllocs()
+	for b.Loop() {
+		agg, err := Aggregate(bytes.NewReader(input))
+		if err != nil {
+			b.Fatal(err)
+		}
+		agg.Close()
+	}
+}
+
+// Printing a million stations to /dev/null through small and large output
+// buffers, each flush a write.
+func BenchmarkOutputBufferSize(b *testing.B) {
+	opts := defaultArgs()
+	agg := newAggregator(opts)
+	if err := agg.AddReader(bytes.NewReader(genMeasurements(2_000_000, genNames(1_000_000, 3, 20)))); err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	for _, size := range []int{minOutputBufferSize, outputBufferSize, 1 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			for b.Loop() {
+				w := bufio.NewWriterSize(f, size)
+				if err := errors.Join(printSolutions(w, agg, opts), w.Flush()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The worker maps grown by the inserts of new stations against prewarmed
+// with the whole station set, as -stations-file does.
+func BenchmarkStationsFile(b *testing.B) {
+	for _, stations := range []int{10_000, 100_000} {
+		names := genNames(stations, 3, 20)
+		input := genMeasurements(1<<20, names)
+		for _, prewarm := range []bool{false, true} {
+			name := fmt.Sprintf("stations=%d/inserts", stations)
+			if prewarm {
+				name = fmt.Sprintf("stations=%d/prewarmed", stations)
+			}
+			b.Run(name, func(b *testing.B) {
+				opts := defaultArgs()
+				opts.workers = 1
+				if prewarm {
+					opts.stations = slices.Sorted(slices.Values(names))
+				}
+				benchmarkAggregate(b, opts, input)
+			})
+		}
+	}
+}
+
+// The scan for the ; from the end of the line of -ascii-fast against the one
+// from its start, across name lengths.
+func BenchmarkASCIIFast(b *testing.B) {
+	for _, lengths := range []struct {
+		name     string
+		min, max int
+	}{{"short", 3, 12}, {"long", 30, 100}} {
+		input := genMeasurements(1<<20, genNames(1000, lengths.min, lengths.max))
+		for _, fast := range []bool{false, true} {
+			name := lengths.name + "/default"
+			if fast {
+				name = lengths.name + "/ascii-fast"
+			}
+			b.Run(name, func(b *testing.B) {
+				opts := defaultArgs()
+				opts.workers = 1
+				opts.asciiFast = fast
+				benchmarkAggregate(b, opts, input)
+			})
+		}
+	}
+}
+
+// The loop over the lines of a chunk, checking the error of every solveLine.
+func BenchmarkProcessBuffer(b *testing.B) {
+	chunk := genMeasurements(300_000, genNames(400, 3, 20))
+	p := newParser(defaultArgs())
+	b.SetBytes(int64(len(chunk)))
+	for b.Loop() {
+		p.processBuffer(chunk)
+		if p.err != nil {
+			b.Fatal(p.err)
+		}
+	}
+}
+
+// The lookups of a skewed input, where a few stations take most rows, with
+// and without the -hot-stations cache in front of the map.
+func BenchmarkHotStations(b *testing.B) {
+	input := genSkewedMeasurements(1<<20, genNames(10_000, 3, 20))
+	for _, hot := range []int{0, 8, maxHotStations} {
+		b.Run(fmt.Sprintf("hot-stations=%d", hot), func(b *testing.B) {
+			opts := defaultArgs()
+			opts.workers = 1
+			opts.hotStations = hot
+			benchmarkAggregate(b, opts, input)
+		})
+	}
+}
+
+// Mostly rows of stations not seen before, the worst case of the name
+// allocations, with and without -name-arena.
+func BenchmarkNameArena(b *testing.B) {
+	input := genMeasurements(1<<20, genNames(1<<20, 8, 30))
+	for _, arena := range []bool{false, true} {
+		b.Run(fmt.Sprintf("name-arena=%v", arena), func(b *testing.B) {
+			opts := defaultArgs()
+			opts.workers = 1
+			opts.nameArena = arena
+			benchmarkAggregate(b, opts, input)
+		})
+	}
+}
+
+// Lines of hundreds of bytes, whose partial line at the end of every read is
+// moved back to the start of the buffer or left in place with -no-carry-copy.
+func BenchmarkNoCarryCopy(b *testing.B) {
+	input := genMeasurements(1<<18, genNames(1000, 200, 2000))
+	for _, noCopy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("no-carry-copy=%v", noCopy), func(b *testing.B) {
+			opts := defaultArgs()
+			opts.noCarryCopy = noCopy
+			benchmarkAggregate(b, opts, input)
+		})
+	}
+}
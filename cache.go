@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// With -cache the printed results are kept in a sidecar next to the first
+// file, with a header describing what they were computed from
+//
+//	1brc-cache <size>:<mtime unix nanos> ... args=<quoted command line>
+//
+// with one size and mtime per input file, followed by the output itself.
+// A later run with the same command line on unchanged files prints the
+// sidecar instead of solving again, any change to a file or to the flags
+// solves again and replaces it.
+
+func cachePath(filename string) string {
+	return filename + ".cache"
+}
+
+func cacheHeader(a args) (string, error) {
+	var b strings.Builder
+	b.WriteString("1brc-cache")
+	for _, filename := range a.filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		if !info.Mode().IsRegular() {
+			return "", fmt.Errorf("%s is a %v, streams cannot be cached", filename, info.Mode().Type())
+		}
+		fmt.Fprintf(&b, " %d:%d", info.Size(), info.ModTime().UnixNano())
+	}
+	fmt.Fprintf(&b, " args=%q", strings.Join(os.Args[1:], " "))
+	return b.String(), nil
+}
+
+// Print the cached results if they are still valid, otherwise solve, print
+// and cache them. Partial results are never cached.
+func solveAndPrintCached(ctx context.Context, a args) error {
+	header, err := cacheHeader(a)
+	if err != nil {
+		return err
+	}
+	path := cachePath(a.filename)
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if cached, ok := bytes.CutPrefix(b, []byte(header+"\n")); ok {
+		slog.Info("using the cached results", "cache", path)
+		return writeOutput(a, func(w io.Writer) error {
+			_, err := w.Write(cached)
+			return err
+		})
+	}
+	if b != nil {
+		slog.Info("the cached results are stale, solving again", "cache", path)
+	}
+
+	agg, err := solve1brc(ctx, a)
+	if err != nil {
+		if agg != nil {
+			agg.Close()
+		}
+		return err
+	}
+	defer agg.Close()
+	if a.failOnEmpty && agg.Rows() == 0 {
+		return errEmptyInput
+	}
+	var out bytes.Buffer
+	out.WriteString(header + "\n")
+	if err := errors.Join(printSolutions(&out, agg, a), agg.Err()); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		slog.Warn("could not write the cache", "err", err)
+	}
+	return writeOutput(a, func(w io.Writer) error {
+		_, err := w.Write(out.Bytes()[len(header)+1:])
+		return err
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// With -columns the text format prints the selected columns of every station
+// in the given order, separated by ;, e.g. -columns mean,min,max,name prints
+// 2.0;1.0;3.0;Paris. A name of -quoted can hold a ; of its own, it is printed
+// as is, so such names are best put last.
+
+// Parse the comma separated names of -columns, once the flags adding columns
+// are known.
+func parseColumns(v string, a args) ([]string, error) {
+	known := []string{"name", "min", "mean", "max", "count", "bytes"}
+	if a.provenance {
+		known = append(known, "first", "last")
+	}
+	for _, p := range a.percentiles {
+		known = append(known, "p"+strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	if a.anomaly {
+		known = append(known, "anomaly")
+	}
+	for _, agg := range a.aggs {
+		if !slices.Contains(known, agg) {
+			known = append(known, agg)
+		}
+	}
+
+	columns := strings.Split(v, ",")
+	for _, c := range columns {
+		if !slices.Contains(known, c) {
+			return nil, fmt.Errorf("unknown column %q, expected one of %s, the row, percentile and anomaly columns need -provenance, -percentiles and -anomaly", c, strings.Join(known, ", "))
+		}
+	}
+	return columns, nil
+}
+
+// The value of a column of -columns for the station. The aggregations of
+// -aggs take their names over from the default columns.
+func (a args) column(c string, s StationStats, globalMean float64) string {
+	if i := slices.Index(a.aggs, c); i >= 0 {
+		return formatTenths(s.Aggs[i])
+	}
+	for i, p := range a.percentiles {
+		if c == "p"+strconv.FormatFloat(p, 'f', -1, 64) {
+			return formatTenths(s.Percentiles[i])
+		}
+	}
+	switch c {
+	case "name":
+		return s.Name
+	case "min":
+		return formatTenths(s.Min)
+	case "mean":
+		return formatTenths(s.Mean)
+	case "max":
+		return formatTenths(s.Max)
+	case "count":
+		return strconv.Itoa(s.Count)
+	case "bytes":
+		return strconv.FormatInt(s.Bytes, 10)
+	case "first":
+		return strconv.FormatInt(s.FirstRow, 10)
+	case "last":
+		return strconv.FormatInt(s.LastRow, 10)
+	case "anomaly":
+		return formatTenths(roundTenths(s.Mean - globalMean))
+	}
+	panic("unknown column " + c) // parseColumns only lets the above through
+}
+
+func printColumns(w io.Writer, s StationStats, a args, globalMean float64) {
+	cells := make([]string, len(a.columns))
+	for i, c := range a.columns {
+		cells[i] = a.column(c, s, globalMean)
+	}
+	fmt.Fprintln(w, strings.Join(cells, ";"))
+}
+
+// A station of -emit-empty in the -columns, with NA for its values.
+func printEmptyColumns(w io.Writer, name string, a args) {
+	cells := make([]string, len(a.columns))
+	for i, c := range a.columns {
+		switch c {
+		case "name":
+			cells[i] = name
+		case "count":
+			cells[i] = "0"
+		default:
+			cells[i] = "NA"
+		}
+	}
+	fmt.Fprintln(w, strings.Join(cells, ";"))
+}
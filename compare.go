@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Parse a reference output, either one <station>=<v>/<v>/... per line as
+// printed here or the single {<station>=<v>/<v>/..., ...} line of the
+// official implementation. Anything after the values, like the count of
+// -counts, is ignored.
+func parseReference(b []byte) (map[string][]float64, []string, error) {
+	text := strings.TrimSpace(string(b))
+	entries := strings.Split(text, "\n")
+	if strings.HasPrefix(text, "{") && strings.HasSuffix(text, "}") {
+		entries = strings.Split(text[1:len(text)-1], ", ")
+	}
+
+	ref := make(map[string][]float64, len(entries))
+	order := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e == "" || strings.HasPrefix(e, "#") {
+			continue
+		}
+		eq := strings.LastIndexByte(e, '=')
+		if eq < 0 {
+			return nil, nil, fmt.Errorf("missing '=' in reference %q", e)
+		}
+		values, _, _ := strings.Cut(e[eq+1:], " ")
+		var vs []float64
+		for v := range strings.SplitSeq(values, "/") {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("bad value in reference %q: %w", e, err)
+			}
+			vs = append(vs, f)
+		}
+		if _, ok := ref[e[:eq]]; !ok {
+			order = append(order, e[:eq])
+		}
+		ref[e[:eq]] = vs
+	}
+	return ref, order, nil
+}
+
+// Solve the files and compare the stations that would be printed against the
+// -compare reference, writing every difference to w: - for a station only in
+// the reference, + for one only in the results and ~ for differing values.
+// Values within -compare-tolerance of the reference are equal, a missing or
+// extra station never is.
+func compareResults(ctx context.Context, a args, w io.Writer) error {
+	b, err := os.ReadFile(a.compare)
+	if err != nil {
+		return err
+	}
+	ref, order, err := parseReference(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.compare, err)
+	}
+
+	agg, err := solve1brc(ctx, a)
+	if agg != nil {
+		defer agg.Close()
+	}
+	if err != nil {
+		return err
+	}
+	got, err := agg.Result()
+	if err != nil {
+		return err
+	}
+
+	diffs := 0
+	seen := make(map[string]bool, len(got))
+	for _, s := range got {
+		if s.Count < a.minCount || !a.printStation(s) {
+			continue
+		}
+		seen[s.Name] = true
+		want, ok := ref[s.Name]
+		if !ok {
+			fmt.Fprintf(w, "+ %s=%s\n", s.Name, formatValues(s.values()))
+			diffs++
+			continue
+		}
+		if !valuesWithin(s.values(), want, a.compareTolerance) {
+			fmt.Fprintf(w, "~ %s: want %s, got %s\n", s.Name, formatValues(want), formatValues(s.values()))
+			diffs++
+		}
+	}
+	for _, name := range order {
+		if !seen[name] {
+			fmt.Fprintf(w, "- %s=%s\n", name, formatValues(ref[name]))
+			diffs++
+		}
+	}
+	if diffs > 0 {
+		return fmt.Errorf("compare: %d differences from %s", diffs, a.compare)
+	}
+	slog.Info("results match the reference", "stations", len(seen), "reference", a.compare, "tolerance", a.compareTolerance)
+	return nil
+}
+
+// Whether got has the values of want, each within tol. The tenths are compared
+// as printed, so a tol of 0 asks for the same output.
+func valuesWithin(got, want []float64, tol float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(roundTenths(got[i])-want[i]) > tol+1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func formatValues(vs []float64) string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = formatTenths(v)
+	}
+	return strings.Join(s, "/")
+}
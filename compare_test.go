@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompareTolerance(t *testing.T) {
+	input := writeInput(t, "Paris;12.3\nOslo;-4.0\n")
+	compare := func(reference string, args ...string) (string, int) {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "reference.txt")
+		if err := os.WriteFile(path, []byte(reference), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-quiet", "-log-level", "error", "-compare", path}, args...)
+		stdout, _, code := run1brc(t, "", append(args, input)...)
+		return stdout, code
+	}
+
+	// a float based implementation a tenth off on a mean and a max
+	off := "{Oslo=-4.0/-4.1/-4.0, Paris=12.3/12.3/12.4}\n"
+	if stdout, code := compare(off); code != exitIOError || stdout != "~ Oslo: want -4.0/-4.1/-4.0, got -4.0/-4.0/-4.0\n~ Paris: want 12.3/12.3/12.4, got 12.3/12.3/12.3\n" {
+		t.Errorf("without a tolerance: exit code %d, stdout %q", code, stdout)
+	}
+	if stdout, code := compare(off, "-compare-tolerance", "0.1"); code != exitOK || stdout != "" {
+		t.Errorf("within the tolerance: exit code %d, stdout %q", code, stdout)
+	}
+	if stdout, code := compare("Oslo=-4.0/-4.2/-4.0\nParis=12.3/12.3/12.3\n", "-compare-tolerance", "0.1"); code != exitIOError || !strings.HasPrefix(stdout, "~ Oslo") {
+		t.Errorf("past the tolerance: exit code %d, stdout %q", code, stdout)
+	}
+
+	// a missing or extra station is never within it
+	if stdout, code := compare("Paris=12.3/12.3/12.3\nLima=1.0/1.0/1.0\n", "-compare-tolerance", "100"); code != exitIOError || stdout != "+ Oslo=-4.0/-4.0/-4.0\n- Lima=1.0/1.0/1.0\n" {
+		t.Errorf("missing and extra stations: exit code %d, stdout %q", code, stdout)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Shared datasets often come compressed. With -compression auto, the default,
+// a file is decompressed on the fly if its extension or, for a regular file,
+// its first bytes name a known codec. Only the codecs of the standard library,
+// gzip and bzip2, are decoded; zstd is still detected, to fail with a clear
+// error instead of parsing the frames as lines. A decompressed file is read
+// like a UTF-16 one: as a stream without an index or segments, terminated like
+// terminatedReader does, so -strict-spec cannot tell an unterminated last line
+// of it.
+
+var compressionExts = map[string]string{".gz": "gzip", ".bz2": "bzip2", ".zst": "zstd"}
+
+var compressionMagics = []struct {
+	codec string
+	magic []byte
+}{
+	{"gzip", []byte{0x1F, 0x8B}},
+	{"bzip2", []byte("BZh")},
+	{"zstd", []byte{0x28, 0xB5, 0x2F, 0xFD}},
+}
+
+// The codec the file is compressed with, none if it is not.
+func detectCompression(f *os.File, compression string) (string, error) {
+	if compression != "auto" {
+		return compression, nil
+	}
+	if codec, ok := compressionExts[filepath.Ext(f.Name())]; ok {
+		return codec, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "none", nil // streams cannot be peeked at without a copy
+	}
+	head := make([]byte, 4)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(head[:n], m.magic) {
+			return m.codec, nil
+		}
+	}
+	return "none", nil
+}
+
+// The decompressed contents of the file, nil if it is not compressed.
+func decompressReader(f *os.File, compression string, sep byte) (io.Reader, error) {
+	codec, err := detectCompression(f, compression)
+	if err != nil {
+		return nil, err
+	}
+	switch codec {
+	case "gzip":
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		return &sepTerminator{r: r, sep: sep}, nil
+	case "bzip2":
+		return &sepTerminator{r: bzip2.NewReader(f), sep: sep}, nil
+	case "zstd":
+		return nil, fmt.Errorf("%s: zstd input is not supported, decompress it first, e.g. zstd -dc %[1]s | 1brc /dev/stdin", f.Name())
+	}
+	return nil, nil
+}
+
+// Terminate a stream whose last byte is not sep.
+type sepTerminator struct {
+	r    io.Reader
+	sep  byte
+	last byte
+	seen bool // any byte, an empty stream is left empty
+	eof  bool
+}
+
+func (t *sepTerminator) Read(b []byte) (int, error) {
+	if t.eof {
+		if t.seen && t.last != t.sep && len(b) > 0 {
+			b[0], t.last = t.sep, t.sep
+			return 1, nil
+		}
+		return 0, io.EOF
+	}
+	n, err := t.r.Read(b)
+	if n > 0 {
+		t.last, t.seen = b[n-1], true
+	}
+	if err == io.EOF {
+		t.eof = true
+		if n == 0 {
+			return t.Read(b)
+		}
+		return n, nil // the separator or EOF on the next read
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The stations of the file, solved with the default options.
+func solveFile(t *testing.T, filename string) string {
+	t.Helper()
+	a := defaultArgs()
+	a.filename, a.filenames = filename, []string{filename}
+	a.aggs = []string{"min", "max", "count"} // the means may round either way
+	agg, err := solve1brc(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agg.Close()
+	return summary(t, agg)
+}
+
+// Copy the file to one of the name in a new directory, returning its path.
+func copyTestdata(t *testing.T, filename, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCompressedInput(t *testing.T) {
+	want := solveFile(t, "testdata/measurements.txt")
+	for _, ext := range []string{".gz", ".bz2"} {
+		t.Run(ext, func(t *testing.T) {
+			if got := solveFile(t, "testdata/measurements.txt"+ext); got != want {
+				t.Errorf("got\n%swant\n%s", got, want)
+			}
+			// detected from the first bytes without the extension
+			if got := solveFile(t, copyTestdata(t, "testdata/measurements.txt"+ext, "measurements")); got != want {
+				t.Errorf("by its first bytes got\n%swant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCompressedShuffleCheck(t *testing.T) {
+	a := defaultArgs()
+	a.filename = "testdata/measurements.txt.gz"
+	a.filenames = []string{a.filename}
+	if err := shuffleCheck(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressedPeek(t *testing.T) {
+	a := defaultArgs()
+	a.filename = "testdata/measurements.txt.gz"
+	var b strings.Builder
+	if err := peek(a, 2, &b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "st4402                          13.8\nst2067                         -48.9\n"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestZstdUnsupported(t *testing.T) {
+	frame := []byte{0x28, 0xB5, 0x2F, 0xFD, 0x24, 0x0B, 0x59, 0, 0}
+	for name, args := range map[string][]string{
+		"extension":    {copyTestdata(t, "testdata/measurements.txt", "measurements.txt.zst")},
+		"first bytes":  {writeInput(t, string(frame))},
+		"-compression": {"-compression", "zstd", writeInput(t, "Paris;12.3\n")},
+	} {
+		_, stderr, code := run1brc(t, "", append([]string{"-quiet"}, args...)...)
+		if code != exitIOError || !strings.Contains(stderr, "zstd input is not supported, decompress it first") {
+			t.Errorf("%s: exit code %d, stderr %q", name, code, stderr)
+		}
+	}
+}
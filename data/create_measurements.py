@@ -32,9 +32,12 @@ def check_args(file_args):
         if len(file_args) < 2 or int(file_args[1]) <= 0:
             raise Exception()
     except:
-        print("Usage:  create_measurements.py <positive integer number of records to create> <filename>")
+        print("Usage:  create_measurements.py <positive integer number of records to create> <filename> [<number of stations>]")
         print("        You can use underscore notation for large number of records.")
         print("        For example:  1_000_000_000 for one billion")
+        print("        Without a number of stations 10_000 are drawn from the known names,")
+        print("        possibly repeating some. With one they are all distinct, past the")
+        print("        known names they get a numbered suffix, e.g. for 500_000 stations")
         exit()
 
 
@@ -99,14 +102,31 @@ def estimate_file_size(weather_station_names, num_rows_to_create):
     return f"Estimated max file size is:  {human_file_size}."
 
 
-def build_test_data(filename, weather_station_names, num_rows_to_create):
+def pick_station_names(weather_station_names, num_stations):
+    """
+    Picks the station names of the test data: 10_000 of the known names, possibly
+    repeated, by default, otherwise num_stations distinct names, suffixing the
+    known names with a number once there are not enough of them
+    """
+    if num_stations is None:
+        return random.choices(weather_station_names, k=10_000)
+    if num_stations <= len(weather_station_names):
+        return random.sample(weather_station_names, k=num_stations)
+    station_names = list(weather_station_names)
+    while len(station_names) < num_stations:
+        station = random.choice(weather_station_names)
+        station_names.append(f"{station}-{len(station_names)}")
+    return station_names
+
+
+def build_test_data(filename, weather_station_names, num_rows_to_create, num_stations):
     """
     Generates and writes to file the requested length of test data
     """
     start_time = time.time()
     coldest_temp = -99.9
     hottest_temp = 99.9
-    station_names_10k_max = random.choices(weather_station_names, k=10_000)
+    station_names = pick_station_names(weather_station_names, num_stations)
     batch_size = 10000 # instead of writing line by line to file, process a batch of stations and put it to disk
     chunks = num_rows_to_create // batch_size
     print('Building test data...')
@@ -116,7 +136,7 @@ def build_test_data(filename, weather_station_names, num_rows_to_create):
             progress = 0
             for chunk in range(chunks):
                 
-                batch = random.choices(station_names_10k_max, k=batch_size)
+                batch = random.choices(station_names, k=batch_size)
                 prepped_deviated_batch = '\n'.join([f"{station};{random.uniform(coldest_temp, hottest_temp):.1f}" for station in batch]) # :.1f should quicker than round on a large scale, because round utilizes mathematical operation
                 file.write(prepped_deviated_batch + '\n')
                 
@@ -151,10 +171,13 @@ def main():
     filename = "./measurements.txt"
     if len(sys.argv) > 2:
         filename = sys.argv[2]
+    num_stations = None
+    if len(sys.argv) > 3:
+        num_stations = int(sys.argv[3])
     weather_station_names = []
     weather_station_names = build_weather_station_name_list()
     print(estimate_file_size(weather_station_names, num_rows_to_create))
-    build_test_data(filename, weather_station_names, num_rows_to_create)
+    build_test_data(filename, weather_station_names, num_rows_to_create, num_stations)
     print("Test data build complete.")
 
 
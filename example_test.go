@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func ExampleAggregate() {
+	agg, err := Aggregate(strings.NewReader("Paris;12.3\nOslo;-4.0\nParis;14.1\n"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer agg.Close()
+	agg.ForEachSorted(func(s StationStats) {
+		fmt.Printf("%s=%.1f/%.1f/%.1f\n", s.Name, s.Min, s.Mean, s.Max)
+	})
+	// Output:
+	// Oslo=-4.0/-4.0/-4.0
+	// Paris=12.3/13.2/14.1
+}
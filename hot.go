@@ -0,0 +1,55 @@
+package main
+
+import "bytes"
+
+// With -hot-stations every parser keeps a small direct mapped cache of the
+// stations it saw last in front of its map. On skewed inputs, where a few
+// stations make most of the rows, their lookups skip hashing the whole name.
+// A slot is picked from the length and the first and last bytes of the name,
+// and always replaced on a miss. The cache holds pointers into the map, so it
+// is emptied whenever the map is.
+type hotStation struct {
+	name []byte // a copy, reused by the next station taking the slot
+	item *solutionItem
+}
+
+// Largest -hot-stations, the cache must stay small to be cheaper than the map.
+const maxHotStations = 1 << 12
+
+// The cache of n slots, rounded up to a power of two, nil for none.
+func newHotCache(n int) []hotStation {
+	if n <= 0 {
+		return nil
+	}
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	return make([]hotStation, size)
+}
+
+// The slot of a name that is not empty.
+func hotSlot(name []byte, mask int) int {
+	return (len(name)*31 + int(name[0])*7 + int(name[len(name)-1])) & mask
+}
+
+func (p *parser) hotLookup(name []byte) *solutionItem {
+	if e := &p.hot[hotSlot(name, len(p.hot)-1)]; e.item != nil && bytes.Equal(e.name, name) {
+		return e.item
+	}
+	return nil
+}
+
+func (p *parser) hotStore(name []byte, item *solutionItem) {
+	e := &p.hot[hotSlot(name, len(p.hot)-1)]
+	e.name = append(e.name[:0], name...)
+	e.item = item
+}
+
+// Empty the solution of the parser, and the cache pointing into it.
+func (p *parser) clearSolution() {
+	clear(p.solution)
+	for i := range p.hot {
+		p.hot[i].item = nil
+	}
+}
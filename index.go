@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An index sidecar records the file offsets right after the last record
+// separator of every chunk the reader would produce, so later runs read each
+// chunk exactly up to its boundary instead of scanning back for it. It is a
+// text file with a header describing the input it was built for
+//
+//	1brc-index size=<bytes> mtime=<unix nanos> chunk=<bytes> sep=<byte>
+//
+// followed by one offset per line.
+
+func indexPath(filename string) string {
+	return filename + ".idx"
+}
+
+func indexHeader(info os.FileInfo, sep byte) string {
+	return fmt.Sprintf("1brc-index size=%d mtime=%d chunk=%d sep=%d", info.Size(), info.ModTime().UnixNano(), readBufferSize, sep)
+}
+
+// Scan the file for its chunk boundaries and write them next to it.
+func buildIndex(filename string, sep byte) error {
+	// stat before opening, opening a fifo blocks until a writer shows up
+	if info, err := os.Stat(filename); err == nil && !info.Mode().IsRegular() && !info.IsDir() {
+		return fmt.Errorf("can only index regular files, %s is a %v", filename, info.Mode().Type())
+	}
+	f, err := openInput(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(indexPath(filename))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, indexHeader(info, sep))
+
+	buf := make([]byte, readBufferSize)
+	pos := int64(0)
+	for {
+		n, err := io.ReadFull(io.NewSectionReader(f, pos, readBufferSize), buf)
+		if n == 0 {
+			break
+		}
+		li := bytes.LastIndexByte(buf[:n], sep)
+		if li < 0 {
+			out.Close()
+			return fmt.Errorf("no record separator within %d bytes at offset %d", readBufferSize, pos)
+		}
+		pos += int64(li + 1)
+		fmt.Fprintln(w, pos)
+		if err != nil { // a short read is the end of the file
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Load the index of the file, failing if it was built for a different version
+// of the file or with a different layout.
+func loadIndex(filename string, sep byte) ([]int64, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is a %v, streams have no index", filename, info.Mode().Type())
+	}
+	b, err := os.ReadFile(indexPath(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if lines[0] != indexHeader(info, sep) {
+		return nil, fmt.Errorf("index %s is stale or was built with other settings", indexPath(filename))
+	}
+	boundaries := make([]int64, 0, len(lines)-1)
+	for _, l := range lines[1:] {
+		off, err := strconv.ParseInt(l, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt index %s: %w", indexPath(filename), err)
+		}
+		boundaries = append(boundaries, off)
+	}
+	return boundaries, nil
+}
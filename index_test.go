@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(path, genMeasurements(1_000_000, genNames(300, 3, 20)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a := defaultArgs()
+	a.filename, a.filenames = path, []string{path}
+	solve := func() string {
+		agg, err := solve1brc(context.Background(), a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer agg.Close()
+		return extremes(t, agg)
+	}
+	want := solve()
+
+	if err := buildIndex(path, a.recordSep); err != nil {
+		t.Fatal(err)
+	}
+	boundaries, err := loadIndex(path, a.recordSep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chunks := (info.Size() + readBufferSize - 1) / readBufferSize; len(boundaries) < int(chunks) {
+		t.Errorf("got %d boundaries for %d chunks", len(boundaries), chunks)
+	}
+	a.useIndex = true
+	if got := solve(); got != want {
+		t.Error("the results with -use-index differ from the ones without")
+	}
+
+	// a touched file no longer matches its index
+	if err := os.Chtimes(path, time.Time{}, info.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadIndex(path, a.recordSep); err == nil {
+		t.Error("a stale index loaded")
+	}
+	if got := solve(); got != want {
+		t.Error("the results with a stale index differ from the ones without")
+	}
+}
@@ -1,17 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"math"
+	"math/rand/v2"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
+	"runtime/trace"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
@@ -19,35 +35,398 @@ const (
 	readBufferSize = 4 * 1024 * 1024 // 4 MiB pages
 	educatedJump   = 3               // {city-name; 2:+};[-]{0-9},{0-99}
 
-	workerNum = 16
+	defaultWorkers = 16
+
+	outputBufferSize    = 64 * 1024 // default of -output-buffer-size
+	minOutputBufferSize = 4 * 1024
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// Read and worker buffers are reused across AddReader calls. They are not
+// cleared in between: a chunk only ever exposes the bytes just copied into it.
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, readBufferSize)
+		return &b
+	},
+}
+
+// Exit codes of the executable.
+const (
+	exitOK       = 0
+	exitIOError  = 1 // including bad arguments
+	exitParseErr = 2 // malformed input in -strict mode
+	exitPanic    = 3
 )
 
-func panicHandler() {
+// ParseError is a malformed line found in -strict mode.
+type ParseError struct {
+	Line   int64 // 1 based line number in the stream
+	Text   string
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d %q: %s", e.Line, e.Text, e.Reason)
+}
+
+// The error of the earlier line when both are parse errors, otherwise the
+// first one that is set. Workers stop at their own first malformed line, so
+// which worker reports first depends on the scheduling, not on the input.
+func earliestError(err, other error) error {
+	var pe, po *ParseError
+	if err == nil || (errors.As(err, &pe) && errors.As(other, &po) && po.Line < pe.Line) {
+		return other
+	}
+	return err
+}
+
+// internalError is a panic recovered within a worker.
+type internalError struct {
+	panic any
+	stack []byte
+}
+
+func (e *internalError) Error() string {
+	return fmt.Sprintf("internal error: %v\n%s", e.panic, e.stack)
+}
+
+func panicHandler(code *int) {
 	r := recover()
 	if r != nil {
-		log.Printf("Something went wrong...\n%v\n%s\n", r, debug.Stack())
+		slog.Error("something went wrong", "panic", r, "stack", string(debug.Stack()))
+		*code = exitPanic
 	}
 }
 
-func gracefullyHanldeErrors(err error) {
+var errTerminated = errors.New("terminated by SIGTERM")
+
+// The wall time over which -warn-on-slow-read measures the read throughput.
+const slowReadWindow = time.Second
+
+var errEmptyInput = errors.New("-fail-on-empty: the input has no rows")
+
+var errWorkerStopped = errors.New("a worker stopped before the input was read")
+
+// Called by the workers before every chunk, only set by the tests to stop a
+// worker midway.
+var testHookChunk func()
+
+var errIsDirectory = errors.New("is a directory")
+
+// Open an input file, which must not be a directory.
+func openInput(filename string) (*os.File, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
 	if err != nil {
-		panic(err.Error())
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: filename, Err: errIsDirectory}
+	}
+	return f, nil
+}
+
+// Log the error and map it into the exit code. The usual mistakes with the
+// input path get a short message of their own.
+func gracefullyHanldeErrors(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &pathErr) && errors.Is(err, fs.ErrNotExist):
+		slog.Error("no such file, check the path", "path", pathErr.Path)
+	case errors.As(err, &pathErr) && errors.Is(err, fs.ErrPermission):
+		slog.Error("permission denied, check the file permissions", "path", pathErr.Path)
+	case errors.As(err, &pathErr) && errors.Is(err, errIsDirectory):
+		slog.Error("expected a file but got a directory", "path", pathErr.Path)
+	default:
+		slog.Error(err.Error())
+	}
+
+	var parseErr *ParseError
+	var internalErr *internalError
+	switch {
+	case errors.As(err, &parseErr):
+		return exitParseErr
+	case errors.As(err, &internalErr):
+		return exitPanic
+	default:
+		return exitIOError
 	}
 }
 
 type args struct {
-	filename string
-	profile  bool
+	filename  string
+	filenames []string // every positional argument, filename is the first
+	profile   bool
+	dryRun    bool
+	header    bool
+	sample    float64
+	seed      uint64
+
+	provenance   bool
+	recordSep    byte
+	benchRuns    int
+	watch        bool
+	spill        int
+	workers      int // 0 resolves from the input size, see resolveWorkers
+	subworkers   int
+	strict       bool
+	rangeCheck   bool
+	peek         int
+	output       string
+	format       string
+	timeout      time.Duration
+	buildIndex   bool
+	useIndex     bool
+	mergeOnly    bool
+	counts       bool
+	distinct     bool
+	mergePerFile bool
+
+	normalizeNewlines bool
+	stream            bool
+	anomaly           bool
+	bestEffort        bool
+
+	units string // c or f
+
+	logLevel  slog.Level
+	logFormat string
+
+	include map[string]bool // nil includes every station
+	exclude map[string]bool
+	filter  *regexp.Regexp // nil matches every station
+
+	meanAbove float64
+	meanBelow float64
+	minCount  int
+
+	shuffleCheck bool
+	countHist    string
+
+	outputBufferSize   int
+	mergeWhitespace    bool
+	maxLineLen         int
+	stations           []string // sorted, prewarmed in every worker map
+	groupByPrefix      string
+	quiet              bool
+	asciiFast          bool
+	strictOrder        bool
+	noMergeAlloc       bool
+	emitEmpty          bool
+	quoted             bool
+	profileDuration    time.Duration
+	trace              bool
+	maxMemory          int64 // bytes, 0 keeps the runtime limit
+	fileParallelism    int
+	bytesPerStation    bool
+	verifySorted       bool
+	flushInterval      time.Duration
+	percentiles        []float64 // within (0, 100]
+	strictSpec         bool
+	aggs               []string // names of the registered aggregations
+	dumpKeys           bool
+	rounding           string
+	version            bool
+	parallelSort       bool
+	shardOutput        string
+	shardSize          int
+	unique             bool
+	hotStations        int
+	failOnEmpty        bool
+	nameArena          bool
+	compare            string
+	compareTolerance   float64
+	maxNameLen         int
+	parallelRead       int
+	warnOnSlowRead     float64
+	cache              bool
+	skipBlankLines     bool
+	flagConstant       bool
+	emitSchema         bool
+	columns            []string
+	tdigest            bool
+	tdigestCompression float64
+	noCarryCopy        bool
+	compression        string
+}
+
+// Whether every station is printed on a line of its own, as text, -raw or
+// raw-int.
+func (a args) lineFormat() bool {
+	return a.format == "text" || a.format == "raw" || a.format == "raw-int"
+}
+
+// The options of a run without any flag.
+func defaultArgs() args {
+	return args{
+		recordSep:  '\n',
+		sample:     1,
+		seed:       1,
+		workers:    defaultWorkers,
+		subworkers: 1,
+		units:      "c",
+		logLevel:   slog.LevelInfo,
+		logFormat:  "text",
+		format:     "text",
+		meanAbove:  math.Inf(-1),
+		meanBelow:  math.Inf(1),
+
+		outputBufferSize:   outputBufferSize,
+		maxLineLen:         readBufferSize - 1,
+		fileParallelism:    1,
+		parallelRead:       1,
+		compression:        "auto",
+		flushInterval:      watchFlushInterval,
+		rounding:           "half-away",
+		shardSize:          100_000,
+		tdigestCompression: defaultTDigestCompression,
+		skipBlankLines:     true,
+	}
 }
 
 func parseArgs() (args, error) {
-	a := args{}
+	a := defaultArgs()
 	flag.BoolVar(&a.profile, "p", false, "enable profiling")
+	flag.BoolVar(&a.header, "header", false, "skip the first line of the file as a header")
+	flag.BoolVar(&a.dryRun, "dry-run", false, "print the planned worker/buffer layout to stderr and exit")
+	flag.Float64Var(&a.sample, "sample", a.sample, "probability [0-1] of each row being aggregated, results are estimates when below 1 and empty at 0")
+	flag.Uint64Var(&a.seed, "seed", a.seed, "seed of the random number generator used for -sample and the samples of -percentiles")
+	flag.BoolVar(&a.provenance, "provenance", false, "print the first and last row index where each station was seen")
+	flag.Func("record-sep", "single byte terminating each record, e.g. '\\0' (default '\\n')", func(v string) error {
+		sep, err := parseSeparator(v)
+		a.recordSep = sep
+		return err
+	})
+	flag.IntVar(&a.benchRuns, "bench", 0, "run the solve this many times discarding the output and report timings to stderr")
+	flag.BoolVar(&a.watch, "watch", false, "solve again every time the file changes")
+	flag.IntVar(&a.spill, "spill", 0, "spill partial results to temporary files once a worker holds this many stations, bounding memory")
+	var include, exclude string
+	flag.StringVar(&include, "include", "", "comma separated stations to print, or @file with one station per line")
+	flag.StringVar(&exclude, "exclude", "", "comma separated stations not to print, or @file with one station per line, takes precedence over -include")
+	var filter string
+	flag.StringVar(&filter, "regex-filter", "", "only print stations matching this regular expression")
+	flag.TextVar(&a.logLevel, "log-level", a.logLevel, "minimum level logged: debug, info, warn or error")
+	flag.StringVar(&a.logFormat, "log-format", a.logFormat, "log format: text or json")
+	flag.StringVar(&a.units, "units", a.units, "units of the results: c for Celsius or f for Fahrenheit")
+	flag.IntVar(&a.subworkers, "subworkers", a.subworkers, "split each chunk among this many goroutines within its worker")
+	flag.Float64Var(&a.meanAbove, "mean-above", a.meanAbove, "only print stations with a mean above this value, in -units")
+	flag.Float64Var(&a.meanBelow, "mean-below", a.meanBelow, "only print stations with a mean below this value, in -units")
+	flag.BoolVar(&a.strict, "strict", false, "validate every line and fail on the first malformed one")
+	flag.IntVar(&a.peek, "peek", 0, "print the first n records as parsed and exit")
+	flag.StringVar(&a.output, "o", "", "write the results to this file instead of stdout")
+	flag.StringVar(&a.format, "format", a.format, "output format: text, table to align the columns, json-map for a JSON object keyed by station, or raw-int for station;min;mean;max;count in integer tenths (no parquet, see the README)")
+	flag.DurationVar(&a.timeout, "timeout", 0, "abort the run once it takes longer than this, e.g. 30s")
+	flag.BoolVar(&a.bestEffort, "best-effort", false, "print the results aggregated so far when the run is aborted")
+	flag.BoolVar(&a.buildIndex, "build-index", false, "write the chunk boundaries of the file to <filename>.idx and exit")
+	flag.BoolVar(&a.useIndex, "use-index", false, "read the chunk boundaries from <filename>.idx when it matches the file")
+	flag.BoolVar(&a.mergeOnly, "merge-only", false, "merge the result files printed with -counts given as arguments")
+	flag.BoolVar(&a.counts, "counts", false, "print the number of readings of each station")
+	flag.BoolVar(&a.rangeCheck, "range-check", false, "accept values outside of [-99.9, 99.9] with a warning instead of failing, still failing on them with -strict")
+	flag.BoolVar(&a.distinct, "distinct", false, "only print the number of distinct stations")
+	flag.BoolVar(&a.mergePerFile, "merge-per-file", false, "fold the results of each file before reading the next, bounding the worker maps to a single file")
+	flag.BoolVar(&a.normalizeNewlines, "normalize-newlines", false, "accept \\r\\n line endings along with \\n")
+	flag.BoolVar(&a.stream, "stream", false, "flush every station as soon as it is printed instead of buffering the output")
+	flag.Func("workers", fmt.Sprintf("number of workers, or auto to pick from the input size (default %d)", defaultWorkers), func(v string) error {
+		if v == "auto" {
+			a.workers = 0
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return errors.New("must be auto or a positive number")
+		}
+		a.workers = n
+		return nil
+	})
+	flag.BoolVar(&a.anomaly, "anomaly", false, "print how far the mean of each station is from the mean of all readings")
+	flag.IntVar(&a.minCount, "min-count", 0, "drop stations with fewer readings than this from the output, e.g. 2 to drop likely typos")
+	flag.BoolVar(&a.shuffleCheck, "shuffle-check", false, "solve the lines again in a random order from -seed and fail if the results differ")
+	flag.StringVar(&a.countHist, "count-hist", "", "write a histogram of the readings per station, bucketed by order of magnitude, to this file")
+	flag.IntVar(&a.outputBufferSize, "output-buffer-size", a.outputBufferSize, "bytes of output buffered before writing them out")
+	flag.BoolVar(&a.mergeWhitespace, "merge-whitespace", false, "merge stations whose names only differ by leading or trailing whitespace")
+	flag.IntVar(&a.maxLineLen, "max-line-len", a.maxLineLen, "fail on a line left without a terminator past this many bytes, at most the read buffer size minus one")
+	var stationsFile string
+	flag.StringVar(&stationsFile, "stations-file", "", "file with one expected station per line, inserted into every worker map upfront")
+	flag.StringVar(&a.groupByPrefix, "group-by-prefix", "", "aggregate the stations by the part of their name before this separator, e.g. : for US:Dallas")
+	flag.BoolVar(&a.quiet, "quiet", false, "silence the advisory warnings, such as more workers than CPUs")
+	flag.BoolVar(&a.asciiFast, "ascii-fast", false, "assume single byte station names and values of at most 5 bytes, undefined results on any other input")
+	flag.BoolVar(&a.strictOrder, "strict-order", false, "expect the input sorted by station and print each one as soon as the next starts, failing on any out of order station")
+	flag.BoolVar(&a.noMergeAlloc, "no-merge-alloc", false, "merge the worker results into the map of the first one instead of a new map")
+	flag.BoolVar(&a.emitEmpty, "emit-empty", false, "print the stations of -stations-file without readings as <station>=NA/NA/NA")
+	flag.BoolVar(&a.quoted, "quoted", false, "accept station names in double quotes, which can hold the ; delimiter and \"\" for a quote")
+	flag.DurationVar(&a.profileDuration, "profile-duration", 0, "stop the -p cpu profile after this long, profiling the whole run when 0")
+	flag.BoolVar(&a.trace, "trace", false, "write an execution trace of the run to trace-<time>.out")
+	flag.Func("max-memory", "soft memory limit of the runtime, e.g. 512M or 2G, making the GC work harder as it gets close", func(v string) error {
+		n, err := parseSize(v)
+		a.maxMemory = n
+		return err
+	})
+	flag.IntVar(&a.fileParallelism, "file-parallelism", a.fileParallelism, "read up to this many files at once, sharing -workers among them")
+	flag.BoolVar(&a.bytesPerStation, "bytes-per-station", false, "print the input bytes of the lines of each station")
+	flag.BoolVar(&a.verifySorted, "verify-sorted", false, "fail if the printed stations are not sorted by name, a self test of the sort")
+	flag.DurationVar(&a.flushInterval, "flush-interval", a.flushInterval, "with -watch, print a new snapshot at most this often")
+	flag.Func("percentiles", "comma separated percentiles to print per station, e.g. p95,p99, estimated from a sample of each", func(v string) error {
+		for p := range strings.SplitSeq(v, ",") {
+			f, err := strconv.ParseFloat(strings.TrimPrefix(p, "p"), 64)
+			if err != nil || f <= 0 || f > 100 {
+				return fmt.Errorf("%q is not a percentile within (0, 100]", p)
+			}
+			a.percentiles = append(a.percentiles, f)
+		}
+		return nil
+	})
+	flag.BoolVar(&a.strictSpec, "strict-spec", false, "fail on the first line breaking any rule of the 1brc input, implies -strict and -range-check")
+	flag.Func("aggs", "comma separated aggregations to print instead of min/mean/max: min, max, mean, range or count", func(v string) error {
+		aggs, err := parseAggregations(v)
+		a.aggs = aggs
+		return err
+	})
+	flag.BoolVar(&a.dumpKeys, "dump-keys", false, "only print the sorted station names, one per line")
+	flag.StringVar(&a.rounding, "rounding", a.rounding, "rounding of the mean: half-away, half-up as the official baseline, half-even or truncate")
+	flag.BoolVar(&a.parallelSort, "parallel-sort", false, "sort the station names across all CPUs when there are many of them")
+	flag.StringVar(&a.shardOutput, "shard-output", "", "write the results into numbered files of -shard-size stations in this directory")
+	flag.IntVar(&a.shardSize, "shard-size", a.shardSize, "stations per file of -shard-output")
+	flag.BoolVar(&a.unique, "unique", false, "fail on the first station seen more than once, reporting its line")
+	flag.IntVar(&a.hotStations, "hot-stations", 0, "cache this many recently seen stations per worker in front of its map, for skewed inputs")
+	flag.BoolVar(&a.failOnEmpty, "fail-on-empty", false, "fail instead of printing nothing when the input has no rows")
+	flag.BoolVar(&a.nameArena, "name-arena", false, "copy new station names into per worker blocks instead of allocating each, for inputs of mostly unique stations")
+	flag.StringVar(&a.compare, "compare", "", "compare the results against this reference output and print the differences")
+	flag.Float64Var(&a.compareTolerance, "compare-tolerance", 0, "treat values of -compare within this distance of the reference as equal, e.g. 0.1")
+	flag.IntVar(&a.maxNameLen, "max-name-len", 0, "treat lines with a station name longer than this many bytes as malformed, skipped or fatal with -strict, 0 for no limit")
+	flag.IntVar(&a.parallelRead, "parallel-read", a.parallelRead, "read every regular file as this many segments at once with ReadAt, each with a share of the workers")
+	flag.Float64Var(&a.warnOnSlowRead, "warn-on-slow-read", 0, "warn when reading the input is slower than this many MiB/s, 0 to never warn")
+	flag.BoolVar(&a.cache, "cache", false, "keep the results in a sidecar next to the file and print them again while the files and flags are unchanged")
+	flag.BoolVar(&a.skipBlankLines, "skip-blank-lines", a.skipBlankLines, "skip empty lines, with -strict or when false they are malformed")
+	flag.BoolVar(&a.flagConstant, "flag-constant", false, "warn about every station with several readings all of the same value, likely a stuck sensor")
+	flag.BoolVar(&a.emitSchema, "emit-schema", false, "describe the printed columns before the results, as a # schema line or a _schema key of json-map")
+	var columns string
+	flag.StringVar(&columns, "columns", "", "comma separated columns to print in this order, separated by ;, e.g. mean,min,max,name")
+	flag.BoolVar(&a.tdigest, "tdigest", false, "estimate -percentiles from a t-digest of each station instead of a sample, more accurate in the tails")
+	flag.Float64Var(&a.tdigestCompression, "tdigest-compression", a.tdigestCompression, "compression of -tdigest, about the number of centroids kept per station, higher is more accurate")
+	flag.BoolVar(&a.noCarryCopy, "no-carry-copy", false, "alternate two read buffers so the partial line at the end of a read is not moved back to the start of the buffer")
+	flag.StringVar(&a.compression, "compression", a.compression, "codec of the input files: auto to detect it from their extension or first bytes, none, gzip or bzip2; zstd is detected but not supported")
+	var raw bool
+	flag.BoolVar(&raw, "raw", false, "print station;min;max;sum;count with the sum in integer tenths, for -merge-only to recompute exact means")
+	flag.BoolVar(&a.version, "version", false, "print the module version, Go version and build settings and exit")
 	flag.Parse()
+	if a.version {
+		return a, nil // needs no filename
+	}
 
 	flag.Usage = func() {
 		fmt.Println(`This is a Go implementation for 1brc. To run it try with:
-		<executable> <filename>
+		<executable> <filename> [<filename>...]
 
 You can also enable profiling with
 		<executable> -p <filename>`)
@@ -60,231 +439,2562 @@ You can also enable profiling with
 		return a, errors.New("no filename was provided! executable is expected to run with: <bin> <filename>")
 	}
 	a.filename = sysargs[0]
+	a.filenames = sysargs
+
+	if a.recordSep == ';' {
+		return a, errors.New("-record-sep must differ from the ';' field delimiter")
+	}
+	var err error
+	if include != "" {
+		if a.include, err = parseStationList(include); err != nil {
+			return a, err
+		}
+	}
+	if exclude != "" {
+		if a.exclude, err = parseStationList(exclude); err != nil {
+			return a, err
+		}
+	}
+	if filter != "" {
+		if a.filter, err = regexp.Compile(filter); err != nil {
+			return a, err
+		}
+	}
+	if raw {
+		if a.format != "text" || a.aggs != nil || a.units != "c" || a.emitEmpty {
+			return a, errors.New("-raw is a format of its own in Celsius, it cannot run with -format, -aggs, -units f or -emit-empty")
+		}
+		a.format = "raw"
+	}
+	switch a.format {
+	case "text", "table", "json-map", "raw":
+	case "raw-int":
+		if a.aggs != nil || a.emitEmpty {
+			return a, errors.New("-format raw-int prints min, mean and max, it cannot run with -aggs or -emit-empty")
+		}
+	case "parquet":
+		return a, errors.New("-format parquet is not supported, 1brc only builds on the standard library, convert the json-map output instead")
+	default:
+		return a, fmt.Errorf("unknown -format %q", a.format)
+	}
+	switch a.rounding {
+	case "half-away", "half-up", "half-even", "truncate":
+	default:
+		return a, fmt.Errorf("-rounding must be half-away, half-up, half-even or truncate, got %q", a.rounding)
+	}
+	if a.units != "c" && a.units != "f" {
+		return a, fmt.Errorf("-units must be c or f, got %q", a.units)
+	}
+	if a.logFormat != "text" && a.logFormat != "json" {
+		return a, fmt.Errorf("-log-format must be text or json, got %q", a.logFormat)
+	}
+	if a.subworkers < 1 {
+		return a, fmt.Errorf("-subworkers must be at least 1, got %d", a.subworkers)
+	}
+	if a.spill < 0 {
+		return a, fmt.Errorf("-spill must not be negative, got %d", a.spill)
+	}
+	if a.peek < 0 {
+		return a, fmt.Errorf("-peek must not be negative, got %d", a.peek)
+	}
+	if a.benchRuns < 0 {
+		return a, fmt.Errorf("-bench must not be negative, got %d", a.benchRuns)
+	}
+	if a.outputBufferSize < minOutputBufferSize {
+		return a, fmt.Errorf("-output-buffer-size must be at least %d, got %d", minOutputBufferSize, a.outputBufferSize)
+	}
+	if a.mergeWhitespace && a.spill > 0 {
+		return a, errors.New("-merge-whitespace needs the stations in memory, it cannot run with -spill")
+	}
+	if a.strictOrder && (a.anomaly || a.distinct || a.dumpKeys || a.mergeWhitespace || a.groupByPrefix != "" || a.emitEmpty || !a.lineFormat()) {
+		return a, errors.New("-strict-order prints every station before reading the next, it cannot run with -anomaly, -distinct, -dump-keys, -merge-whitespace, -group-by-prefix, -emit-empty or a -format other than text")
+	}
+	if a.groupByPrefix != "" && a.spill > 0 {
+		return a, errors.New("-group-by-prefix needs the stations in memory, it cannot run with -spill")
+	}
+	if stationsFile != "" {
+		if a.spill > 0 {
+			return a, errors.New("-stations-file keeps every station in the worker maps, it cannot run with -spill")
+		}
+		stations, err := parseStationList("@" + stationsFile)
+		if err != nil {
+			return a, err
+		}
+		a.stations = slices.Sorted(maps.Keys(stations))
+	}
+	if a.emitEmpty && a.stations == nil {
+		return a, errors.New("-emit-empty needs the expected stations of -stations-file")
+	}
+	if a.maxLineLen < 1 || a.maxLineLen >= readBufferSize {
+		return a, fmt.Errorf("-max-line-len must be within [1, %d], got %d", readBufferSize-1, a.maxLineLen)
+	}
+	if a.strictSpec {
+		a.strict, a.rangeCheck = true, true
+	}
+	if a.aggs != nil && (a.spill > 0 || a.units != "c") {
+		return a, errors.New("-aggs keeps its aggregations in memory and in Celsius, it cannot run with -spill or -units f")
+	}
+	if len(a.percentiles) > 0 && a.spill > 0 {
+		return a, errors.New("-percentiles keeps its samples in memory, it cannot run with -spill")
+	}
+	if a.tdigest && len(a.percentiles) == 0 {
+		return a, errors.New("-tdigest estimates the percentiles of -percentiles, it needs them")
+	}
+	if a.tdigestCompression < 1 {
+		return a, fmt.Errorf("-tdigest-compression must be at least 1, got %v", a.tdigestCompression)
+	}
+	if a.fileParallelism < 1 {
+		return a, fmt.Errorf("-file-parallelism must be at least 1, got %d", a.fileParallelism)
+	}
+	if a.fileParallelism > 1 && (a.spill > 0 || a.provenance || a.mergePerFile) {
+		return a, errors.New("-file-parallelism reads the files out of order, it cannot run with -spill, -provenance or -merge-per-file")
+	}
+	if a.cache && (a.countHist != "" || a.stream) {
+		return a, errors.New("-cache only keeps the printed results, it cannot run with -count-hist or -stream")
+	}
+	if columns != "" {
+		if a.format != "text" {
+			return a, errors.New("-columns orders the columns of the text format, it cannot run with another -format")
+		}
+		if a.columns, err = parseColumns(columns, a); err != nil {
+			return a, err
+		}
+	}
+	if a.emitSchema && a.format == "table" {
+		return a, errors.New("-emit-schema describes the columns of formats without a header, -format table has one")
+	}
+	if a.emitSchema && a.shardOutput != "" {
+		return a, errors.New("-emit-schema would take a line of the first shard, it cannot run with -shard-output")
+	}
+	if a.warnOnSlowRead < 0 {
+		return a, fmt.Errorf("-warn-on-slow-read must not be negative, got %v", a.warnOnSlowRead)
+	}
+	if !slices.Contains([]string{"auto", "none", "gzip", "bzip2", "zstd"}, a.compression) {
+		return a, fmt.Errorf("-compression must be auto, none, gzip, bzip2 or zstd, got %q", a.compression)
+	}
+	if a.parallelRead < 1 {
+		return a, fmt.Errorf("-parallel-read must be at least 1, got %d", a.parallelRead)
+	}
+	if a.parallelRead > 1 && (a.spill > 0 || a.mergePerFile || a.fileParallelism > 1 || a.trackRows()) {
+		return a, errors.New("-parallel-read counts the lines within each segment, it cannot run with -spill, -merge-per-file, -file-parallelism or the options reporting rows or lines")
+	}
+	if a.flushInterval < 0 {
+		return a, fmt.Errorf("-flush-interval must not be negative, got %v", a.flushInterval)
+	}
+	if a.profileDuration < 0 {
+		return a, fmt.Errorf("-profile-duration must not be negative, got %v", a.profileDuration)
+	}
+	if a.unique && (a.spill > 0 || a.fileParallelism > 1) {
+		return a, errors.New("-unique compares the stations of every worker in memory along a single count of lines, it cannot run with -spill or -file-parallelism")
+	}
+	if a.hotStations < 0 || a.hotStations > maxHotStations {
+		return a, fmt.Errorf("-hot-stations must be within [0, %d], got %d", maxHotStations, a.hotStations)
+	}
+	if a.maxNameLen < 0 {
+		return a, fmt.Errorf("-max-name-len must not be negative, got %d", a.maxNameLen)
+	}
+	if a.compareTolerance < 0 {
+		return a, fmt.Errorf("-compare-tolerance must not be negative, got %v", a.compareTolerance)
+	}
+	if a.shardSize < 1 {
+		return a, fmt.Errorf("-shard-size must be at least 1, got %d", a.shardSize)
+	}
+	if a.shardOutput != "" && (a.output != "" || !a.lineFormat()) {
+		return a, errors.New("-shard-output writes one station per line to its own files, it cannot run with -o or a -format other than text")
+	}
+	if a.minCount < 0 {
+		return a, fmt.Errorf("-min-count must not be negative, got %d", a.minCount)
+	}
+	if a.sample < 0 || a.sample > 1 {
+		return a, fmt.Errorf("-sample must be within [0, 1], got %v", a.sample)
+	}
 	return a, nil
 }
 
+// Rows are counted for -provenance and to report the line of -strict,
+// -range-check, -unique and -max-name-len errors.
+func (a args) trackRows() bool {
+	return a.provenance || a.strict || a.rangeCheck || a.unique || a.maxNameLen > 0
+}
+
+// Logs go to stderr, leaving stdout for the results.
+func newLogger(a args) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: a.logLevel}
+	if a.logFormat == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// Parse either a comma separated list of stations or, prefixed by @, a file
+// with one station per line.
+func parseStationList(v string) (map[string]bool, error) {
+	names := strings.Split(v, ",")
+	if path, ok := strings.CutPrefix(v, "@"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		names = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+
+	stations := make(map[string]bool, len(names))
+	for _, name := range names {
+		stations[name] = true
+	}
+	return stations, nil
+}
+
+// Parse a size in bytes with an optional K, M, G or T binary suffix, e.g. 2G.
+func parseSize(v string) (int64, error) {
+	mult := int64(1)
+	if n := len(v); n > 0 {
+		if i := strings.IndexByte("KMGT", v[n-1]&^0x20); i >= 0 {
+			mult = 1 << (10 * (i + 1))
+			v = v[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 || n > math.MaxInt64/mult {
+		return 0, errors.New("must be a positive size such as 512M or 2G")
+	}
+	return n * mult, nil
+}
+
+// Parse a single byte given either literally or as an escape sequence such as
+// \n, \t, \x00 or the shorthand \0.
+func parseSeparator(v string) (byte, error) {
+	if v == `\0` {
+		return 0, nil
+	}
+	if len(v) == 1 {
+		return v[0], nil
+	}
+	r, _, tail, err := strconv.UnquoteChar(v, 0)
+	if err != nil || tail != "" || r > 0xFF {
+		return 0, fmt.Errorf("separator must be a single byte, got %q", v)
+	}
+	return byte(r), nil
+}
+
 // From the rules:
 // > Temperature value: non null double between -99.9 (inclusive) and 99.9 (inclusive), always with one fractional digit
-func fastParseFloat64(b []byte) float64 {
+//
+// Anything that is not [-+]d+.d is reported as not ok instead of read out of
+// bounds, the range is left to the caller.
+func fastParseFloat64(b []byte) (float64, bool) {
 	num := 0
 	i := 0
 	neg := false
-	if b[i] == '-' {
-		neg = true
-		i++ // skip '-'
+	if len(b) > 0 {
+		switch b[i] {
+		case '-':
+			neg = true
+			i++ // skip '-'
+		case '+':
+			i++ // skip '+', some generators sign the positive values too
+		}
 	}
-	for {
-		if b[i] == '.' {
-			break
+	start := i
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		if num < 1e6 { // out of range anyway, don't overflow
+			num *= 10
+			num += int(b[i]) - 48
 		}
-		num *= 10
-		num += int(b[i]) - 48
-
 		i++
 	}
-	i++ // skip '.'
-	dec := .1 * float64(int(b[i])-48)
+	if i == start || len(b) != i+2 || b[i] != '.' || b[i+1] < '0' || b[i+1] > '9' {
+		return 0, false
+	}
+	i++ // skip '.'
+	dec := .1 * float64(int(b[i])-48)
+
+	if neg {
+		return -(float64(num) + dec), true
+	}
+
+	return float64(num) + dec, true
+}
+
+type solutionItem struct {
+	min   temp
+	max   temp
+	count int
+	acc   float64
+
+	// only tracked with -provenance
+	firstRow int64
+	lastRow  int64
+
+	bytes int64 // of the lines, without their separators
+
+	samples *reservoir // only with -percentiles
+	digest  *tdigest   // instead of samples with -tdigest
+
+	aggs []Aggregation // only with -aggs, in the order of the flag
+}
+
+func (item *solutionItem) merge(v *solutionItem) {
+	if v.aggs != nil {
+		if item.aggs == nil {
+			item.aggs = v.aggs
+		} else {
+			for i, agg := range item.aggs {
+				agg.Merge(v.aggs[i])
+			}
+		}
+	}
+	if v.samples != nil {
+		if item.samples == nil {
+			item.samples = &reservoir{}
+		}
+		*item.samples = mergeReservoirs(*item.samples, item.count, *v.samples, v.count)
+	}
+	if v.digest != nil {
+		if item.digest == nil {
+			item.digest = newTDigest(v.digest.compression)
+		}
+		item.digest.merge(v.digest)
+	}
+	item.acc += v.acc
+	item.count += v.count
+	item.bytes += v.bytes
+	if item.max < v.max {
+		item.max = v.max
+	}
+	if item.min > v.min {
+		item.min = v.min
+	}
+	if item.firstRow > v.firstRow {
+		item.firstRow = v.firstRow
+	}
+	if item.lastRow < v.lastRow {
+		item.lastRow = v.lastRow
+	}
+}
+
+// The sampler keeps each row with probability p. Statistics over the sampled
+// rows are only estimates of the full ones.
+type sampler struct {
+	p   float64
+	rng *rand.Rand
+}
+
+func (s *sampler) keep() bool {
+	return s.rng.Float64() < s.p
+}
+
+// The parser aggregates lines into the solution owned by a single worker.
+type parser struct {
+	solution map[string]*solutionItem
+	smp      *sampler   // nil keeps every row
+	rng      *rand.Rand // of the -percentiles samples
+	sep      byte
+	jump     int // bytes safe to skip after a line break
+
+	// With -normalize-newlines a \r before the separator is dropped. Only
+	// needed to validate lines: the value parsing already stops at the
+	// fractional digit and never looks at the \r.
+	crlf bool
+
+	// With -strict every line is validated before parsing, and the first
+	// malformed one stops the parser.
+	strict     bool
+	rangeCheck bool
+	lineBase   int64 // line number of row 0
+
+	// With -ascii-fast the ; is searched from the end of the line, where the
+	// value is at most 5 bytes away, instead of walking the whole name.
+	asciiFast bool
+
+	// With -quoted a name starting with " runs to its closing quote.
+	quoted bool
+
+	// With -percentiles every station keeps a sample of its readings, or a
+	// t-digest of this compression with -tdigest.
+	percentiles bool
+	tdigest     float64
+
+	// With -strict-spec the validation also checks validateSpec.
+	spec bool
+
+	// With -aggs every station gets an instance of these aggregations.
+	aggs []string
+
+	// With -unique a second reading of a station stops the parser.
+	unique bool
+
+	// With -max-name-len longer names are malformed, 0 for no limit.
+	maxNameLen int
+
+	// Empty lines are skipped with -skip-blank-lines, unless strict.
+	skipBlank bool
+
+	// With -hot-stations the cache in front of solution, see hot.go.
+	hot []hotStation
+
+	// With -name-arena the keys of solution are allocated here, see arena.go.
+	names *nameArena
+
+	// With trackRows the reader hands over the index of the first row of each
+	// chunk, counted by the reader since it sees every chunk in order, and the
+	// parser keeps counting from there within the chunk.
+	trackRows bool
+	row       int64
+
+	// rows seen by this parser, kept local so the hot path never contends
+	// on a shared counter
+	rows int64
+
+	// With -spill the solution is written into a run in spillDir every time
+	// it grows past spillAt stations.
+	spillDir string
+	spillAt  int
+	runs     []string
+	err      error
+}
+
+func newParser(opts args) *parser {
+	p := &parser{
+		solution:   make(map[string]*solutionItem, len(opts.stations)),
+		sep:        opts.recordSep,
+		jump:       educatedJump,
+		strict:     opts.strict,
+		rangeCheck: opts.rangeCheck,
+		crlf:       opts.normalizeNewlines,
+		lineBase:   1,
+		trackRows:  opts.trackRows(),
+		asciiFast:  opts.asciiFast,
+		quoted:     opts.quoted,
+
+		percentiles: len(opts.percentiles) > 0,
+		spec:        opts.strictSpec,
+		aggs:        opts.aggs,
+		unique:      opts.unique,
+		maxNameLen:  opts.maxNameLen,
+		skipBlank:   opts.skipBlankLines && !opts.strict,
+		hot:         newHotCache(opts.hotStations),
+	}
+	if opts.nameArena {
+		p.names = &nameArena{}
+	}
+	if opts.tdigest {
+		p.tdigest = opts.tdigestCompression
+	}
+	if p.percentiles {
+		p.rng = rand.New(rand.NewPCG(^opts.seed, 0))
+	}
+	if opts.strict {
+		p.jump = 0 // a malformed line might be shorter than the jump
+	}
+	if opts.header {
+		p.lineBase++
+	}
+	// the expected stations hit only updates in the hot path, their zero
+	// count items are initialised by solveLine on their first reading
+	for _, name := range opts.stations {
+		p.solution[name] = &solutionItem{}
+	}
+	return p
+}
+
+func (p *parser) maybeSpill(force bool) {
+	if p.spillAt <= 0 || p.err != nil || len(p.solution) == 0 {
+		return
+	}
+	if !force && len(p.solution) < p.spillAt {
+		return
+	}
+	run, err := spill(p.spillDir, p.solution)
+	p.clearSolution() // spill cleared the map, the cache must follow
+	if err != nil {
+		p.err = err
+		return
+	}
+	p.runs = append(p.runs, run)
+}
+
+// Fold the line into the solution. Lines are only validated with -strict, but
+// a line without a ; or a value is an error here too rather than a panic, as
+// there is nothing to fold.
+func (p *parser) solveLine(line []byte) error {
+	i := 0
+	var name []byte
+	if p.quoted && len(line) > 0 && line[0] == '"' {
+		if name, i = unquoteName(line); i < 0 {
+			return &ParseError{Line: p.lineBase + p.row, Text: string(line), Reason: "unterminated quoted station name"}
+		}
+	} else if p.asciiFast && len(line) > 4 {
+		i = len(line) - 4 // right before the shortest value, d.d
+		for i > 0 && line[i] != ';' {
+			i--
+		}
+		if line[i] != ';' {
+			i = len(line)
+		}
+	} else {
+		for i < len(line) && line[i] != ';' {
+			i++
+		}
+	}
+	if i+1 >= len(line) {
+		return &ParseError{Line: p.lineBase + p.row, Text: string(line), Reason: "missing ';' or value"}
+	}
+
+	num, ok := fastParseFloat64(line[i+1:]) // skip the ;
+	if !ok {
+		return &ParseError{Line: p.lineBase + p.row, Text: string(line), Reason: "value is not a number with one fractional digit"}
+	}
+	if name == nil {
+		name = line[:i]
+	}
+	if p.maxNameLen > 0 && len(name) > p.maxNameLen {
+		// only the start of the name, it could be megabytes long
+		reason := fmt.Sprintf("station name of %d bytes is longer than -max-name-len %d", len(name), p.maxNameLen)
+		if p.strict {
+			return &ParseError{Line: p.lineBase + p.row, Text: string(name[:p.maxNameLen]) + "...", Reason: reason}
+		}
+		slog.Warn("skipping a station name longer than -max-name-len", "bytes", len(name), "name", string(name[:p.maxNameLen])+"...", "line", p.lineBase+p.row)
+		return nil
+	}
+	if tenths := math.Round(num * 10); tenths < -999 || tenths > 999 {
+		// only -range-check lets them through, with a warning
+		if p.strict || !p.rangeCheck {
+			return &ParseError{Line: p.lineBase + p.row, Text: string(line), Reason: "value out of [-99.9, 99.9]"}
+		}
+		slog.Warn("value out of [-99.9, 99.9]", "station", string(name), "value", num, "line", p.lineBase+p.row)
+	}
+	var s *solutionItem
+	hot := p.hot != nil && len(name) > 0
+	if s == nil && hot {
+		s = p.hotLookup(name)
+	}
+	if s == nil {
+		var ok bool
+		s, ok = p.solution[string(name)]
+		if !ok {
+			s = &solutionItem{}
+			if p.names != nil {
+				p.solution[p.names.string(name)] = s
+			} else {
+				p.solution[string(name)] = s
+			}
+		}
+		if hot {
+			p.hotStore(name, s)
+		}
+	}
+	t := temp(num)
+	if s.count == 0 {
+		*s = solutionItem{min: t, max: t, count: 1, acc: num, firstRow: p.row, lastRow: p.row, bytes: int64(len(line))}
+		if p.tdigest > 0 {
+			s.digest = newTDigest(p.tdigest)
+			s.digest.add(float64(t))
+		} else if p.percentiles {
+			s.samples = &reservoir{t}
+		}
+		if p.aggs != nil {
+			s.aggs = newAggregations(p.aggs)
+			p.observe(s, num)
+		}
+		return nil
+	}
+	if p.unique {
+		return &ParseError{Line: p.lineBase + p.row, Text: string(line), Reason: fmt.Sprintf("station %q seen again, first on line %d", name, p.lineBase+s.firstRow)}
+	}
+
+	s.acc += num
+	s.count += 1
+	s.bytes += int64(len(line))
+	if s.samples != nil {
+		s.samples.add(t, s.count, p.rng)
+	}
+	if s.digest != nil {
+		s.digest.add(float64(t))
+	}
+	if s.aggs != nil {
+		p.observe(s, num)
+	}
+	if s.max < t {
+		s.max = t
+	}
+	if s.min > t {
+		s.min = t
+	}
+	if p.trackRows {
+		s.lastRow = p.row
+	}
+	return nil
+}
+
+func (p *parser) observe(s *solutionItem, num float64) {
+	tenths := int(math.Round(num * 10))
+	for _, agg := range s.aggs {
+		agg.Observe(tenths)
+	}
+}
+
+// Split the buffer on record boundaries into one piece per sub parser, parse
+// the pieces concurrently and fold the sub solutions into the parser's own.
+func (p *parser) processSplit(b []byte, subs []*parser) {
+	var wg sync.WaitGroup
+	start := 0
+	row := p.row
+	for k, sub := range subs {
+		end := len(b)
+		if k < len(subs)-1 {
+			end = start + (len(b)-start)/(len(subs)-k)
+			if i := bytes.IndexByte(b[end:], p.sep); i >= 0 {
+				end += i + 1
+			} else {
+				end = len(b)
+			}
+		}
+
+		piece := b[start:end]
+		sub.row = row
+		if p.trackRows {
+			row += int64(bytes.Count(piece, []byte{p.sep}))
+		}
+		wg.Go(func() { sub.processChunk(piece, nil) })
+		start = end
+	}
+	wg.Wait()
+
+	for _, sub := range subs {
+		p.err = earliestError(p.err, sub.err)
+		p.rows += sub.rows
+		sub.rows = 0
+		if p.unique {
+			p.err = earliestError(p.err, findRepeat(p.solution, sub.solution, p.lineBase))
+		}
+		mergeSolution(p.solution, sub.solution)
+		sub.clearSolution()
+	}
+	p.row = row
+}
+
+// A quoted name runs to the closing quote, with "" standing for a quote within
+// the name, so it can hold the ; delimiter. Return the unquoted name and the
+// index of the delimiter right after the closing quote, or -1 when there is
+// none.
+func unquoteName(line []byte) ([]byte, int) {
+	for j := 1; j < len(line); j++ {
+		if line[j] != '"' {
+			continue
+		}
+		if j+1 < len(line) && line[j+1] == '"' {
+			j++ // an escaped quote
+			continue
+		}
+		if j+1 == len(line) || line[j+1] != ';' {
+			return nil, -1
+		}
+		name := line[1:j]
+		if bytes.Contains(name, []byte(`""`)) {
+			name = bytes.ReplaceAll(name, []byte(`""`), []byte(`"`))
+		}
+		return name, j + 1
+	}
+	return nil, -1
+}
+
+// Validate the line, with -quoted a quoted station name can hold the ;.
+func (p *parser) validateLine(line []byte) string {
+	if p.spec {
+		if reason := validateSpec(line); reason != "" {
+			return reason
+		}
+	}
+	if p.quoted && len(line) > 0 && line[0] == '"' {
+		name, i := unquoteName(line)
+		switch {
+		case i < 0:
+			return "unterminated quoted station name"
+		case len(name) == 0:
+			return "empty station name"
+		}
+		return validateValue(line[i+1:])
+	}
+	return validateLine(line)
+}
+
+// The rules of -strict-spec on top of validateLine, the 1brc input has a
+// single ; per line, names without surrounding whitespace and no + sign.
+func validateSpec(line []byte) string {
+	if bytes.Count(line, []byte{';'}) != 1 {
+		return "not exactly one ';'"
+	}
+	name, value, _ := bytes.Cut(line, []byte{';'})
+	if len(bytes.TrimSpace(name)) != len(name) {
+		return "station name has surrounding whitespace"
+	}
+	if len(value) > 0 && value[0] == '+' {
+		return "explicit '+' sign"
+	}
+	return ""
+}
+
+// Check the line follows <station>;[-+]{0-9}{0-9}?.{0-9}, returning the reason
+// it is malformed or an empty string.
+func validateLine(line []byte) string {
+	i := bytes.IndexByte(line, ';')
+	switch {
+	case i < 0:
+		return "missing ';'"
+	case i == 0:
+		return "empty station name"
+	}
+	return validateValue(line[i+1:])
+}
+
+func validateValue(v []byte) string {
+	if len(v) > 0 && (v[0] == '-' || v[0] == '+') {
+		v = v[1:]
+	}
+	digits := 0
+	for digits < len(v) && v[digits] >= '0' && v[digits] <= '9' {
+		digits++
+	}
+	if digits < 1 || len(v) != digits+2 || v[digits] != '.' || v[digits+1] < '0' || v[digits+1] > '9' {
+		return "value is not a number with one fractional digit"
+	}
+	if digits > 2 {
+		return "value out of [-99.9, 99.9]" // well formed, too many digits
+	}
+	return ""
+}
+
+// Parse the chunk, recovering from any panic into the parser's error so that a
+// bad chunk never takes down the whole process.
+func (p *parser) processChunk(b []byte, subs []*parser) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.err = &internalError{panic: r, stack: debug.Stack()}
+		}
+	}()
+	if subs != nil {
+		p.processSplit(b, subs)
+	} else {
+		p.processBuffer(b)
+	}
+}
+
+func (p *parser) processBuffer(b []byte) {
+	fi := 0 // line front-index
+	ri := 0 // line rear-index
+	for {
+		if fi >= len(b) {
+			break
+		}
+		if b[fi] == p.sep {
+			line := b[ri:fi]
+			if p.crlf && len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			if len(line) == 0 {
+				if !p.skipBlank {
+					p.err = &ParseError{Line: p.lineBase + p.row, Reason: "blank line"}
+					return
+				}
+				p.row++ // still a line, for the line numbers
+				ri = fi + 1
+				fi++
+				continue
+			}
+			if p.strict {
+				if reason := p.validateLine(line); reason != "" {
+					p.err = &ParseError{Line: p.lineBase + p.row, Text: string(line), Reason: reason}
+					return
+				}
+			}
+			if p.smp == nil || p.smp.keep() {
+				err := p.solveLine(line)
+				if err != nil {
+					p.err = err
+					return
+				}
+			}
+			p.row++
+			p.rows++
+			ri = fi + 1 // skip the separator
+			// the jump assumes the shortest line, a blank one is shorter
+			if fi+1 < len(b) && (b[fi+1] == p.sep || (p.crlf && b[fi+1] == '\r')) {
+				fi++
+				continue
+			}
+			fi += p.jump
+		}
+		fi++
+	}
+}
+
+// StationStats is the merged result of a single station, in the -units of the
+// aggregator and rounded to one fractional digit.
+type StationStats struct {
+	Name  string
+	Min   float64
+	Mean  float64
+	Max   float64
+	Count int
+
+	// only tracked with -provenance
+	FirstRow int64
+	LastRow  int64
+
+	Bytes int64 // input bytes of the lines, without their separators
+
+	// the sum of the readings in integer tenths of a degree Celsius, from the
+	// float sum, for -raw
+	SumTenths int64
+
+	// with -percentiles, estimated from a sample of the readings and in the
+	// order of the flag
+	Percentiles []float64
+
+	// with -aggs, the finalized aggregations in the order of the flag,
+	// printed instead of min, mean and max
+	Aggs []float64
+}
+
+// String formats the station as printed by printSolutions without the
+// optional columns, e.g. "Hamburg=-3.2/9.7/25.1".
+func (s StationStats) String() string {
+	values := s.values()
+	cells := make([]string, len(values))
+	for i, v := range values {
+		cells[i] = formatTenths(v)
+	}
+	return s.Name + "=" + strings.Join(cells, "/")
+}
+
+// The min, mean and max, or the -aggs in their place.
+func (s StationStats) values() []float64 {
+	if s.Aggs != nil {
+		return s.Aggs
+	}
+	return []float64{s.Min, s.Mean, s.Max}
+}
+
+// The names of the values of every station, see StationStats.values.
+func (a args) valueColumns() []string {
+	if a.aggs != nil {
+		return a.aggs
+	}
+	return []string{"min", "mean", "max"}
+}
+
+// Aggregator merges the per worker solutions into a single result.
+type Aggregator struct {
+	mu       sync.Mutex
+	opts     args
+	solution map[string]*solutionItem
+
+	// stream position, carried over between readers
+	started bool
+	chunk   uint64
+	row     int64
+
+	rows atomic.Int64 // parsed so far, updated once per chunk
+
+	progress func(Progress) // see SetProgress
+	bytes    int64          // handed to the workers so far, for progress
+
+	boundaries []int64 // chunk boundaries of the next reader, from -use-index
+
+	// with -spill the solutions are kept on disk instead, see spill.go
+	spillDir string
+	runs     []string
+	err      error
+}
+
+func newAggregator(opts args) *Aggregator {
+	return &Aggregator{opts: opts, solution: make(map[string]*solutionItem)}
+}
+
+func (a *Aggregator) merge(s map[string]*solutionItem) {
+	if a.opts.noMergeAlloc && len(a.solution) == 0 {
+		// adopt the first worker map instead of copying it: its worker is
+		// done with it and never merges it again, so nothing counts twice
+		maps.DeleteFunc(s, func(_ string, v *solutionItem) bool { return v.count == 0 })
+		a.solution = s
+		return
+	}
+	mergeSolution(a.solution, s)
+}
+
+// With -unique every worker only catches the repeats within its own chunks,
+// and every sub-parser within its own piece of them, a station seen by two of
+// them is only caught once their solutions meet. The second occurrence is the
+// later of the two first rows, the earliest one of all is reported.
+func (a *Aggregator) checkUnique(s map[string]*solutionItem, lineBase int64) error {
+	return findRepeat(a.solution, s, lineBase)
+}
+
+func findRepeat(dst, s map[string]*solutionItem, lineBase int64) error {
+	var err *ParseError
+	for name, v := range s {
+		if item, ok := dst[name]; ok && item.count > 0 && v.count > 0 {
+			first, second := min(item.firstRow, v.firstRow), max(item.firstRow, v.firstRow)
+			if err == nil || lineBase+second < err.Line {
+				err = &ParseError{Line: lineBase + second, Text: name, Reason: fmt.Sprintf("station %q seen again, first on line %d", name, lineBase+first)}
+			}
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	return err
+}
+
+// Fold src into dst, copying the items so src can still be reused.
+func mergeSolution(dst, src map[string]*solutionItem) {
+	for k, v := range src {
+		mergeItem(dst, k, v)
+	}
+}
+
+func mergeItem(dst map[string]*solutionItem, name string, v *solutionItem) {
+	if v.count == 0 {
+		return // prewarmed by -stations-file but never seen
+	}
+	item, ok := dst[name]
+	if !ok || item.count == 0 {
+		c := *v
+		if v.samples != nil {
+			samples := slices.Clone(*v.samples)
+			c.samples = &samples
+		}
+		if v.digest != nil {
+			c.digest = v.digest.clone()
+		}
+		dst[name] = &c
+		return
+	}
+	item.merge(v)
+}
+
+func roundTenths(v float64) float64 {
+	return math.Round(10*v) / 10
+}
+
+// Round the mean to tenths by the -rounding mode. The default rounds halves
+// away from zero, half-up rounds them towards +Inf like Math.round of the
+// official Java baseline, so it is the one matching its expected outputs on
+// negative means such as -2.25.
+func roundMean(v float64, mode string) float64 {
+	switch mode {
+	case "half-up":
+		return math.Floor(10*v+0.5) / 10
+	case "half-even":
+		return math.RoundToEven(10*v) / 10
+	case "truncate":
+		return math.Trunc(10*v) / 10
+	}
+	return roundTenths(v)
+}
+
+func toFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// The aggregation always happens in Celsius, other units are converted only
+// here and rounded after the conversion.
+func (a *Aggregator) newStationStats(name string, item *solutionItem) StationStats {
+	s := StationStats{
+		Name:  name,
+		Min:   roundTenths(float64(item.min)), // the float32 tenths have noise past them
+		Mean:  roundMean(item.acc/float64(item.count), a.opts.rounding),
+		Max:   roundTenths(float64(item.max)),
+		Count: item.count,
+
+		FirstRow: item.firstRow,
+		LastRow:  item.lastRow,
+		Bytes:    item.bytes,
+
+		SumTenths: int64(math.Round(item.acc * 10)),
+	}
+	if item.aggs != nil {
+		s.Aggs = make([]float64, len(item.aggs))
+		for i, agg := range item.aggs {
+			s.Aggs[i] = roundTenths(agg.Finalize())
+		}
+	}
+	if item.digest != nil && len(a.opts.percentiles) > 0 {
+		s.Percentiles = item.digest.percentiles(a.opts.percentiles)
+	} else if item.samples != nil && len(a.opts.percentiles) > 0 {
+		s.Percentiles = item.samples.percentiles(a.opts.percentiles)
+	}
+	if s.Percentiles != nil {
+		for i, v := range s.Percentiles {
+			if a.opts.units == "f" {
+				v = toFahrenheit(v)
+			}
+			s.Percentiles[i] = roundTenths(v)
+		}
+	}
+	if a.opts.units == "f" {
+		s.Min = roundTenths(toFahrenheit(float64(item.min)))
+		s.Mean = roundMean(toFahrenheit(item.acc/float64(item.count)), a.opts.rounding)
+		s.Max = roundTenths(toFahrenheit(float64(item.max)))
+	}
+	return s
+}
+
+// ForEachSorted calls fn for every merged station, sorted alphabetically by
+// station name. With spilled runs the stations are merged from disk, check Err
+// afterwards.
+func (a *Aggregator) ForEachSorted(fn func(StationStats)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.runs) > 0 {
+		a.err = mergeRuns(a.runs, func(name string, item *solutionItem) {
+			fn(a.newStationStats(name, item))
+		})
+		return
+	}
+
+	keys := make([]string, 0, len(a.solution))
+	for k := range a.solution {
+		keys = append(keys, k)
+	}
+	sortKeys(keys, a.opts.parallelSort)
+	for _, k := range keys {
+		fn(a.newStationStats(k, a.solution[k]))
+	}
+}
+
+// Fold the stations whose names trim to the same name into the trimmed one,
+// e.g. "Paris " into "Paris", a common bug of upstream exports. A lone
+// "Paris " is kept as is, there is nothing to merge it with.
+func (a *Aggregator) mergeWhitespace() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	variants := make(map[string][]string)
+	for k := range a.solution {
+		t := strings.TrimSpace(k)
+		variants[t] = append(variants[t], k)
+	}
+	for t, names := range variants {
+		if len(names) < 2 {
+			continue
+		}
+		slices.Sort(names)
+		merged := make(map[string]*solutionItem, 1)
+		for _, k := range names {
+			mergeItem(merged, t, a.solution[k])
+			delete(a.solution, k)
+		}
+		a.solution[t] = merged[t]
+		slog.Info("merged stations differing by whitespace", "station", t, "names", fmt.Sprintf("%q", names))
+	}
+}
+
+// Re-key the stations by the part of their name before sep, e.g. US:Dallas
+// and US:Austin into US. Names without sep are kept as they are.
+func (a *Aggregator) groupByPrefix(sep string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	grouped := make(map[string]*solutionItem)
+	for k, v := range a.solution {
+		prefix, _, _ := strings.Cut(k, sep)
+		mergeItem(grouped, prefix, v)
+	}
+	a.solution = grouped
+}
+
+// Get returns the merged stats of a single station, and whether it was seen,
+// without sorting or building the stats of the others. With -spill the runs
+// are merged to find it, and their error is left in Err.
+func (a *Aggregator) Get(name string) (StationStats, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.runs) > 0 {
+		var found *solutionItem
+		a.err = mergeRuns(a.runs, func(n string, item *solutionItem) {
+			if n == name {
+				c := *item
+				found = &c
+			}
+		})
+		if found == nil {
+			return StationStats{}, false
+		}
+		return a.newStationStats(name, found), true
+	}
+
+	item, ok := a.solution[name]
+	if !ok || item.count == 0 {
+		return StationStats{}, false
+	}
+	return a.newStationStats(name, item), true
+}
+
+// Progress is the progress of an aggregator as of a chunk handed to the
+// workers.
+type Progress struct {
+	Chunks uint64 // handed to the workers so far, across every reader
+	Bytes  int64  // of the chunks handed to the workers so far
+	Rows   int64  // parsed so far, lagging behind the chunks still parsing
+}
+
+// SetProgress sets fn to be called by the reader right after every chunk is
+// handed to the workers, so once per chunk and never from a worker. It runs
+// with the aggregator locked, fn may call Rows but no other method, and it
+// should return quickly as the next chunk is only read once it does.
+func (a *Aggregator) SetProgress(fn func(Progress)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.progress = fn
+}
+
+// Rows returns the number of rows parsed so far. While a reader is being added
+// it lags behind by at most the chunks being parsed, and it is exact once
+// AddReader returns.
+func (a *Aggregator) Rows() int64 {
+	return a.rows.Load()
+}
+
+// GlobalMean returns the mean of every reading of every station, in -units.
+func (a *Aggregator) GlobalMean() float64 {
+	a.mu.Lock()
+	spilled := len(a.runs) > 0
+	acc, count := 0.0, 0
+	for _, item := range a.solution {
+		acc += item.acc
+		count += item.count
+	}
+	a.mu.Unlock()
+	if spilled {
+		a.mu.Lock()
+		a.err = mergeRuns(a.runs, func(_ string, item *solutionItem) {
+			acc += item.acc
+			count += item.count
+		})
+		a.mu.Unlock()
+	}
+
+	mean := acc / float64(count)
+	if a.opts.units == "f" {
+		return toFahrenheit(mean)
+	}
+	return mean
+}
+
+// Len returns the number of distinct stations.
+func (a *Aggregator) Len() int {
+	a.mu.Lock()
+	spilled := len(a.runs) > 0
+	n := len(a.solution)
+	a.mu.Unlock()
+	if !spilled {
+		return n
+	}
+
+	n = 0
+	a.ForEachSorted(func(StationStats) { n++ })
+	return n
+}
+
+// Result returns every merged station sorted alphabetically by name.
+func (a *Aggregator) Result() ([]StationStats, error) {
+	var stats []StationStats
+	a.ForEachSorted(func(s StationStats) {
+		stats = append(stats, s)
+	})
+	return stats, a.Err()
+}
+
+// Err returns the error, if any, of the last ForEachSorted.
+func (a *Aggregator) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// Close removes the spilled runs, if any.
+func (a *Aggregator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.spillDir == "" {
+		return nil
+	}
+	return os.RemoveAll(a.spillDir)
+}
+
+// Format a value already rounded by roundTenths from its integer tenths, so
+// that %.1f never gets the chance to round it a second time. This also avoids
+// printing -0.0, the reference output prints 0.0 for e.g. a mean of tiny
+// negatives rounded to zero.
+func formatTenths(v float64) string {
+	t := int64(math.Round(10 * v))
+	sign := ""
+	if t < 0 {
+		sign, t = "-", -t
+	}
+	return fmt.Sprintf("%s%d.%d", sign, t/10, t%10)
+}
+
+// Whether the station passes the -include, -exclude, -regex-filter and mean
+// threshold filters. Filtering happens on the merged results so it never
+// affects the aggregation itself.
+func (a args) printStation(s StationStats) bool {
+	if s.Mean <= a.meanAbove || s.Mean >= a.meanBelow {
+		return false
+	}
+	return a.printName(s.Name)
+}
+
+// Whether the station passes the filters on its name alone.
+func (a args) printName(name string) bool {
+	if a.exclude[name] {
+		return false
+	}
+	if a.filter != nil && !a.filter.MatchString(name) {
+		return false
+	}
+	return a.include == nil || a.include[name]
+}
+
+// Emit to w sorted alphabetically by station name, and the result values per
+// station in the format <min>/<mean>/<max>, rounded to one fractional digit.
+// The only error is that of -verify-sorted, the errors of the aggregator are
+// left in agg.Err.
+func printSolutions(w io.Writer, agg *Aggregator, a args) error {
+	if a.mergeWhitespace {
+		agg.mergeWhitespace()
+	}
+	if a.groupByPrefix != "" {
+		agg.groupByPrefix(a.groupByPrefix)
+	}
+	if a.distinct {
+		fmt.Fprintln(w, agg.Len())
+		return nil
+	}
+	if a.dumpKeys {
+		// e.g. to build a -stations-file, so only the name filters apply
+		agg.ForEachSorted(func(s StationStats) {
+			if a.printName(s.Name) {
+				fmt.Fprintln(w, s.Name)
+			}
+		})
+		return nil
+	}
+	var globalMean float64
+	if a.anomaly {
+		globalMean = agg.GlobalMean()
+	}
+	if a.format == "table" {
+		// the table is aligned once every row is in, so -stream cannot
+		// flush the rows one by one
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		defer tw.Flush()
+		w = tw
+		printTableHeader(w, a)
+	}
+	if a.format == "json-map" {
+		// the whole output is a single object, so the entries are separated
+		// as they are printed
+		fmt.Fprint(w, "{")
+		defer fmt.Fprint(w, "\n}\n")
+	}
+	entries := 0
+	entry := func() {
+		if a.format == "json-map" {
+			if entries > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprint(w, "\n  ")
+		}
+		entries++
+	}
+	if a.emitSchema {
+		entry()
+		printSchema(w, a)
+	}
+
+	// with -emit-empty the expected stations without readings are printed
+	// in order among the others as Name=NA/NA/NA, or Name=NA/NA/NA (0) with
+	// -counts, the other columns are left out
+	// with -verify-sorted every printed name is checked against the last one,
+	// a self test of the sort
+	var prev string
+	var unsorted error
+	verify := func(name string) {
+		if a.verifySorted && unsorted == nil && name < prev {
+			unsorted = fmt.Errorf("-verify-sorted: %q was printed after %q", name, prev)
+		}
+		prev = name
+	}
+
+	empty := a.stations
+	printEmpty := func(before string, last bool) {
+		for len(empty) > 0 && (last || empty[0] <= before) {
+			if name := empty[0]; name != before && a.printName(name) {
+				verify(name)
+				entry()
+				printEmptyLine(w, name, a)
+			}
+			empty = empty[1:]
+		}
+	}
+	if !a.emitEmpty {
+		empty = nil
+	}
+
+	dropped := 0
+	agg.ForEachSorted(func(s StationStats) {
+		a.flagIfConstant(s)
+		printEmpty(s.Name, false)
+		if s.Count < a.minCount {
+			dropped++
+			return
+		}
+		if a.printStation(s) {
+			verify(s.Name)
+			entry()
+			printStationLine(w, s, a, globalMean)
+		}
+	})
+	printEmpty("", true)
+	if a.minCount > 0 {
+		slog.Info("dropped stations below -min-count", "stations", dropped, "min_count", a.minCount)
+	}
+	return unsorted
+}
+
+// A column of the output, for -emit-schema.
+type schemaColumn struct {
+	name, typ, unit string
+}
+
+// The columns printed for every station in the active format, in order.
+func (a args) schema() []schemaColumn {
+	unit := "celsius"
+	if a.units == "f" {
+		unit = "fahrenheit"
+	}
+	columns := []schemaColumn{{"station", "string", ""}}
+	if a.columns != nil {
+		// each column as described without -columns, min, mean and max
+		// are only there without -aggs
+		all := a
+		all.columns, all.counts, all.bytesPerStation = nil, true, true
+		described := all.schema()
+		columns = nil
+		for _, c := range a.columns {
+			i := slices.IndexFunc(described, func(d schemaColumn) bool { return d.name == c })
+			switch {
+			case c == "name":
+				columns = append(columns, described[0])
+			case i >= 0:
+				columns = append(columns, described[i])
+			default:
+				columns = append(columns, schemaColumn{c, "decimal", unit})
+			}
+		}
+		return columns
+	}
+	switch a.format {
+	case "raw":
+		return append(columns,
+			schemaColumn{"min", "decimal", "celsius"},
+			schemaColumn{"max", "decimal", "celsius"},
+			schemaColumn{"sum", "integer", "tenths of celsius"},
+			schemaColumn{"count", "integer", ""})
+	case "raw-int":
+		return append(columns,
+			schemaColumn{"min", "integer", "tenths of " + unit},
+			schemaColumn{"mean", "integer", "tenths of " + unit},
+			schemaColumn{"max", "integer", "tenths of " + unit},
+			schemaColumn{"count", "integer", ""})
+	}
+	for _, c := range a.valueColumns() {
+		if c == "count" {
+			columns = append(columns, schemaColumn{c, "decimal", ""})
+		} else {
+			columns = append(columns, schemaColumn{c, "decimal", unit})
+		}
+	}
+	if a.counts {
+		columns = append(columns, schemaColumn{"count", "integer", ""})
+	}
+	if a.provenance {
+		columns = append(columns, schemaColumn{"first", "integer", "row"}, schemaColumn{"last", "integer", "row"})
+	}
+	if a.bytesPerStation {
+		columns = append(columns, schemaColumn{"bytes", "integer", "bytes"})
+	}
+	for _, p := range a.percentiles {
+		columns = append(columns, schemaColumn{"p" + strconv.FormatFloat(p, 'f', -1, 64), "decimal", unit})
+	}
+	if a.anomaly {
+		columns = append(columns, schemaColumn{"anomaly", "decimal", unit})
+	}
+	return columns
+}
+
+// Print the schema of -emit-schema, as the _schema entry of -format json-map
+// or a # schema line, which -merge-only skips like any # line, of the others.
+func printSchema(w io.Writer, a args) {
+	columns := a.schema()
+	if a.format == "json-map" {
+		fields := make([]string, 0, len(columns)-1)
+		for _, c := range columns[1:] { // the station is the key
+			fields = append(fields, fmt.Sprintf("%s: {\"type\": %s, \"unit\": %s}", jsonString(c.name), jsonString(c.typ), jsonString(c.unit)))
+		}
+		fmt.Fprintf(w, "\"_schema\": {%s}", strings.Join(fields, ", "))
+		return
+	}
+	cells := make([]string, len(columns))
+	for i, c := range columns {
+		cells[i] = c.name + " " + c.typ
+		if c.unit != "" {
+			cells[i] += " (" + c.unit + ")"
+		}
+	}
+	fmt.Fprintf(w, "# schema: %s\n", strings.Join(cells, ", "))
+}
+
+// With -flag-constant warn about a station whose readings are all the same,
+// from its min and max. Every station is checked, the output filters do not
+// apply, but a single reading is no sign of a stuck sensor.
+func (a args) flagIfConstant(s StationStats) {
+	if a.flagConstant && s.Count > 1 && s.Min == s.Max {
+		slog.Warn("station reports a constant value", "station", s.Name, "value", s.Min, "count", s.Count)
+	}
+}
+
+// A station of -emit-empty, with NA for each of its values.
+func printEmptyLine(w io.Writer, name string, a args) {
+	na := make([]string, len(a.valueColumns()))
+	for i := range na {
+		na[i] = "NA"
+	}
+	if a.format == "json-map" {
+		fmt.Fprintf(w, "%s: null", jsonString(name))
+		return
+	}
+	if a.columns != nil {
+		printEmptyColumns(w, name, a)
+		return
+	}
+	if a.format == "table" {
+		for i := range na {
+			na[i] = fmt.Sprintf("%6s", na[i])
+		}
+		if a.counts {
+			na = append(na, "0")
+		}
+		fmt.Fprintf(w, "%s\t%s\n", name, strings.Join(na, "\t"))
+		return
+	}
+	fmt.Fprintf(w, "%s=%s", name, strings.Join(na, "/"))
+	if a.counts {
+		fmt.Fprint(w, " (0)")
+	}
+	fmt.Fprintln(w)
+}
+
+// The columns of -format table, matching the cells of printTableRow.
+func printTableHeader(w io.Writer, a args) {
+	cells := []string{"station"}
+	for _, c := range a.valueColumns() {
+		cells = append(cells, fmt.Sprintf("%6s", c))
+	}
+	if a.counts {
+		cells = append(cells, "count")
+	}
+	if a.provenance {
+		cells = append(cells, "first", "last")
+	}
+	if a.bytesPerStation {
+		cells = append(cells, "bytes")
+	}
+	for _, p := range a.percentiles {
+		cells = append(cells, fmt.Sprintf("%6s", "p"+strconv.FormatFloat(p, 'f', -1, 64)))
+	}
+	if a.anomaly {
+		cells = append(cells, "anomaly")
+	}
+	fmt.Fprintln(w, strings.Join(cells, "\t"))
+}
+
+// A row of -format table, with the cells separated by tabs for the tabwriter
+// to align. The values are right aligned within their cells so the decimal
+// points line up.
+func printTableRow(w io.Writer, s StationStats, a args, globalMean float64) {
+	cells := []string{s.Name}
+	for _, v := range s.values() {
+		cells = append(cells, fmt.Sprintf("%6s", formatTenths(v)))
+	}
+	if a.counts {
+		cells = append(cells, strconv.Itoa(s.Count))
+	}
+	if a.provenance {
+		cells = append(cells, strconv.FormatInt(s.FirstRow, 10), strconv.FormatInt(s.LastRow, 10))
+	}
+	if a.bytesPerStation {
+		cells = append(cells, strconv.FormatInt(s.Bytes, 10))
+	}
+	for _, v := range s.Percentiles {
+		cells = append(cells, fmt.Sprintf("%6s", formatTenths(v)))
+	}
+	if a.anomaly {
+		cells = append(cells, fmt.Sprintf("%7s", formatTenths(roundTenths(s.Mean-globalMean))))
+	}
+	fmt.Fprintln(w, strings.Join(cells, "\t"))
+}
+
+// An entry of -format json-map, the station name keying an object of the
+// columns printed by the text format. The entries are separated by the caller.
+func printJSONEntry(w io.Writer, s StationStats, a args, globalMean float64) {
+	fields := []string{}
+	field := func(k, v string) { fields = append(fields, jsonString(k)+": "+v) }
+	for i, v := range s.values() {
+		field(a.valueColumns()[i], formatTenths(v))
+	}
+	if a.counts {
+		field("count", strconv.Itoa(s.Count))
+	}
+	if a.provenance {
+		field("first", strconv.FormatInt(s.FirstRow, 10))
+		field("last", strconv.FormatInt(s.LastRow, 10))
+	}
+	if a.bytesPerStation {
+		field("bytes", strconv.FormatInt(s.Bytes, 10))
+	}
+	for i, v := range s.Percentiles {
+		field("p"+strconv.FormatFloat(a.percentiles[i], 'f', -1, 64), formatTenths(v))
+	}
+	if a.anomaly {
+		field("anomaly", formatTenths(roundTenths(s.Mean-globalMean)))
+	}
+	fmt.Fprintf(w, "%s: {%s}", jsonString(s.Name), strings.Join(fields, ", "))
+}
+
+// A JSON string literal, escaping whatever the station name holds.
+func jsonString(v string) string {
+	b, _ := json.Marshal(v) // a string always marshals
+	return string(b)
+}
+
+// Print a single station with the optional columns enabled in a.
+func printStationLine(w io.Writer, s StationStats, a args, globalMean float64) {
+	if a.format == "table" {
+		printTableRow(w, s, a, globalMean)
+		return
+	}
+	if a.format == "json-map" {
+		printJSONEntry(w, s, a, globalMean)
+		return
+	}
+	if a.format == "raw" {
+		// only what a reducer needs, the optional columns are left out
+		fmt.Fprintf(w, "%s;%s;%s;%d;%d\n", s.Name, formatTenths(s.Min), formatTenths(s.Max), s.SumTenths, s.Count)
+		return
+	}
+	if a.format == "raw-int" {
+		// the values as printed times ten, in -units, so 12.3 is 123
+		tenths := func(v float64) int64 { return int64(math.Round(v * 10)) }
+		fmt.Fprintf(w, "%s;%d;%d;%d;%d\n", s.Name, tenths(s.Min), tenths(s.Mean), tenths(s.Max), s.Count)
+		return
+	}
+	if a.columns != nil {
+		printColumns(w, s, a, globalMean)
+	} else {
+		fmt.Fprint(w, s.String())
+		if a.counts {
+			fmt.Fprintf(w, " (%d)", s.Count)
+		}
+		if a.provenance {
+			fmt.Fprintf(w, " first=%d last=%d", s.FirstRow, s.LastRow)
+		}
+		if a.bytesPerStation {
+			fmt.Fprintf(w, " bytes=%d", s.Bytes)
+		}
+		for i, v := range s.Percentiles {
+			fmt.Fprintf(w, " p%s=%s", strconv.FormatFloat(a.percentiles[i], 'f', -1, 64), formatTenths(v))
+		}
+		if a.anomaly {
+			// from the rounded mean, as printed
+			fmt.Fprintf(w, " anomaly=%s", formatTenths(roundTenths(s.Mean-globalMean)))
+		}
+		fmt.Fprintln(w)
+	}
+	if f, ok := w.(*bufio.Writer); ok && a.stream {
+		f.Flush()
+	}
+}
+
+type workItem struct {
+	bufferIndex int
+	bufferLen   int
+	chunk       uint64
+	firstRow    int64
+}
+
+// With -workers auto there is one worker per autoWorkerBytes of input, so that
+// files of a few buffers are solved by a single worker without spinning up a
+// pool of buffers they would never fill, up to one worker per CPU. Input of
+// unknown size, given as -1, gets one worker per CPU.
+const autoWorkerBytes = 4 * readBufferSize
+
+func resolveWorkers(workers int, size int64) int {
+	if workers > 0 {
+		return workers
+	}
+	if size < 0 {
+		return runtime.NumCPU()
+	}
+	return int(min(max((size+autoWorkerBytes-1)/autoWorkerBytes, 1), int64(runtime.NumCPU())))
+}
+
+// Print the build details to include in issue reports.
+func printVersion(w io.Writer) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Fprintf(w, "1brc (no build info) %s\n", runtime.Version())
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", info.Main.Path, info.Main.Version)
+	fmt.Fprintf(w, "go:       %s %s/%s\n", info.GoVersion, runtime.GOOS, runtime.GOARCH)
+	tags, race := "", "false"
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "-tags":
+			tags = setting.Value
+		case "-race":
+			race = setting.Value
+		case "vcs.revision":
+			fmt.Fprintf(w, "revision: %s\n", setting.Value)
+		}
+	}
+	fmt.Fprintf(w, "tags:     %s\n", tags)
+	fmt.Fprintf(w, "race:     %s\n", race)
+	fmt.Fprintf(w, "min/max:  %T\n", temp(0)) // float32 with the float32 tag
+}
+
+// Report the layout solve1brc would use for the file without processing it.
+// The chunk count is an estimate: the carry over of partial lines might add
+// a few more reads at the end.
+func dryRun(a args) error {
+	filename := a.filename
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &fs.PathError{Op: "stat", Path: filename, Err: errIsDirectory}
+	}
 
-	if neg {
-		return -(float64(num) + dec)
+	fmt.Fprintf(os.Stderr, "file:        %s\n", filename)
+	if !info.Mode().IsRegular() {
+		// a pipe or socket is a stream of unknown length
+		fmt.Fprintf(os.Stderr, "file size:   unknown, %v is not a regular file\n", info.Mode().Type())
+		fmt.Fprintf(os.Stderr, "workers:     %d\n", resolveWorkers(a.workers, -1))
+		fmt.Fprintf(os.Stderr, "buffer size: %d bytes\n", readBufferSize)
+		fmt.Fprintf(os.Stderr, "mmap:        %v\n", false)
+		fmt.Fprintf(os.Stderr, "chunks:      unknown\n")
+		return nil
 	}
 
-	return float64(num) + dec
+	size := info.Size()
+	chunks := (size + readBufferSize - 1) / readBufferSize
+	fmt.Fprintf(os.Stderr, "file size:   %d bytes\n", size)
+	fmt.Fprintf(os.Stderr, "workers:     %d\n", resolveWorkers(a.workers, size))
+	fmt.Fprintf(os.Stderr, "buffer size: %d bytes\n", readBufferSize)
+	fmt.Fprintf(os.Stderr, "mmap:        %v\n", false)
+	fmt.Fprintf(os.Stderr, "chunks:      %d\n", chunks)
+	return nil
 }
 
-type solutionItem struct {
-	min   float64
-	max   float64
-	count int
-	acc   float64
-}
+// Print the first n records of the file as parsed, without aggregating them.
+// Files with fewer records print all of them.
+func peek(a args, n int, w io.Writer) error {
+	f, err := openInput(a.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	in, _, err := inputReader(f, a.recordSep, a.compression)
+	if err != nil {
+		return err
+	}
 
-func solveLine(line []byte, solution map[string]*solutionItem) error {
-	i := 0
-	for {
-		if line[i] == ';' {
-			break
+	r := bufio.NewReader(in)
+	if b, err := r.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		r.Discard(len(utf8BOM))
+	}
+	line := int64(1)
+	if a.header {
+		if _, err := r.ReadSlice(a.recordSep); err != nil {
+			return nil // only a header, nothing to print
 		}
-		i++
+		line++
 	}
 
-	name := string(line[:i])
-	s, ok := solution[name]
-	if !ok {
-		s = &solutionItem{}
-		solution[name] = s
+	for printed := 0; printed < n; {
+		b, err := r.ReadBytes(a.recordSep)
+		b = bytes.TrimSuffix(b, []byte{a.recordSep})
+		if a.normalizeNewlines {
+			b = bytes.TrimSuffix(b, []byte{'\r'})
+		}
+		if len(b) > 0 {
+			if reason := validateLine(b); reason != "" {
+				return &ParseError{Line: line, Text: string(b), Reason: reason}
+			}
+			sc := bytes.IndexByte(b, ';')
+			v, _ := fastParseFloat64(b[sc+1:]) // validated above
+			fmt.Fprintf(w, "%-30s %5.1f\n", b[:sc], v)
+			printed++
+		}
+		line++
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	i++ // skip the ;
-	num := fastParseFloat64(line[i:])
-	s.acc += num
-	s.count += 1
-	if s.max < num {
-		s.max = num
-	}
-	if s.min > num {
-		s.min = num
+// Aggregate every record of r with the default options, see ExampleAggregate.
+func Aggregate(r io.Reader) (*Aggregator, error) {
+	agg := newAggregator(defaultArgs())
+	if err := agg.AddReader(r); err != nil {
+		agg.Close()
+		return nil, err
 	}
-	return nil
+	return agg, nil
 }
 
-func processBuffer(b []byte, solution map[string]*solutionItem) {
-	fi := 0 // line front-index
-	ri := 0 // line rear-index
-	for {
-		if fi >= len(b) {
-			break
+// Solve the files. When the context is done the error is returned along with
+// the partial results if -best-effort is set.
+//
+// The files are read as one logical stream through a single pipeline, unless
+// -merge-per-file is set: then each file gets a pipeline of its own, whose
+// worker maps are folded into the aggregator and freed before the next file.
+func solve1brc(ctx context.Context, a args) (*Aggregator, error) {
+	readers := make([]io.Reader, 0, len(a.filenames))
+	decoded := false // the index offsets are in the compressed or UTF-16 bytes
+	for _, filename := range a.filenames {
+		f, err := openInput(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		// a read blocked on a pipe only returns once the file is closed
+		defer context.AfterFunc(ctx, func() { f.Close() })()
+		r, isDecoded, err := inputReader(f, a.recordSep, a.compression)
+		if err != nil {
+			return nil, err
+		}
+		if a.strictSpec && !isDecoded {
+			if err := checkTerminated(f, a.recordSep); err != nil {
+				return nil, err
+			}
 		}
-		if b[fi] == '\n' {
-			err := solveLine(b[ri:fi], solution)
+		decoded = decoded || isDecoded
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() && a.parallelRead > 1 && !isDecoded {
+			segments, err := segmentReaders(f, a.parallelRead, a.recordSep)
 			if err != nil {
-				log.Printf("[ERROR] %v", err)
-				return
+				return nil, err
 			}
-			ri = fi + 1 // skip \n
-			fi += educatedJump
+			readers = append(readers, segments...)
+			continue
 		}
-		fi++
+		readers = append(readers, r)
 	}
-}
-
-// Emit to stdout sorted alphabetically by station name, and the result values
-// per station in the format <min>/<mean>/<max>, rounded to one fractional digit.
-func printSolutions(solutions []map[string]*solutionItem) {
-	solution := make(map[string]*solutionItem, workerNum)
-	for _, s := range solutions {
-		for k, v := range s {
-			item, ok := solution[k]
-			if !ok {
-				item = v
-				solution[k] = item
-			}
 
-			// merge the maps
-			item.acc += v.acc
-			item.count += v.count
-			if item.max < v.max {
-				item.max = v.max
+	if a.workers == 0 {
+		size := int64(0)
+		for _, filename := range a.filenames {
+			info, err := os.Stat(filename)
+			if err != nil {
+				return nil, err
 			}
-			if item.min > v.min {
-				item.min = v.min
+			if !info.Mode().IsRegular() {
+				size = -1 // a pipe or socket, its size says nothing
+				break
 			}
+			size += info.Size()
 		}
+		a.workers = resolveWorkers(0, size)
+		slog.Debug("resolved the number of workers", "workers", a.workers, "bytes", size)
 	}
 
-	keys := make([]string, 0, len(solution))
-	for k := range solution {
-		keys = append(keys, k)
+	agg := newAggregator(a)
+	if a.useIndex && decoded {
+		slog.Warn("not using the index", "err", "the input is compressed or UTF-16, decoded before reading")
+	} else if a.useIndex {
+		var err error
+		agg.boundaries, err = loadIndex(a.filename, a.recordSep)
+		if err != nil {
+			slog.Warn("not using the index", "err", err)
+		}
 	}
-	slices.Sort(keys)
-	for _, k := range keys {
-		item := solution[k]
-		mean := math.Round(10*item.acc/float64(item.count)) / 10 // rounded to 1 decimal point
-		fmt.Printf("%s=%.1f/%.1f/%.1f\n", k, item.min, mean, item.max)
+
+	var err error
+	if a.parallelRead > 1 {
+		slog.Info("starting to read files", "files", a.filenames, "chunk_bytes", readBufferSize, "segments", len(readers))
+		err = agg.addReadersConcurrently(ctx, readers, a.parallelRead)
+	} else if a.fileParallelism > 1 && len(readers) > 1 {
+		slog.Info("starting to read files", "files", a.filenames, "chunk_bytes", readBufferSize, "file_parallelism", a.fileParallelism)
+		err = agg.addReadersConcurrently(ctx, readers, a.fileParallelism)
+	} else if a.mergePerFile {
+		for i, r := range readers {
+			slog.Info("starting to read file", "file", a.filenames[i], "chunk_bytes", readBufferSize)
+			if err = agg.AddReaderContext(ctx, r); err != nil {
+				break
+			}
+		}
+	} else {
+		slog.Info("starting to read files", "files", a.filenames, "chunk_bytes", readBufferSize)
+		err = agg.AddReaderContext(ctx, io.MultiReader(readers...))
+	}
+	if err != nil {
+		if (a.bestEffort || errors.Is(err, errTerminated)) && ctx.Err() != nil {
+			return agg, err
+		}
+		agg.Close()
+		return nil, err
 	}
+	return agg, nil
 }
 
-type workItem struct {
-	bufferIndex int
-	bufferLen   int
+// Read up to k of the readers at once, each by an aggregator of its own with
+// a share of the workers, folding each one into a as soon as it is done. Only
+// the first reader can have a header, as if they were read back to back, but
+// -strict and -range-check count the lines of every reader from its start.
+func (a *Aggregator) addReadersConcurrently(ctx context.Context, readers []io.Reader, k int) error {
+	opts := a.opts
+	opts.workers = max(1, opts.workers/k)
+	a.mu.Lock()
+	boundaries := a.boundaries
+	a.boundaries = nil
+	a.mu.Unlock()
+
+	sem := make(chan struct{}, k)
+	errs := make([]error, len(readers))
+	var wg sync.WaitGroup
+	for i, r := range readers {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			fopts := opts
+			fopts.header = opts.header && i == 0
+			fagg := newAggregator(fopts)
+			if i == 0 {
+				fagg.boundaries = boundaries // the index is of the first file
+			}
+			errs[i] = fagg.AddReaderContext(ctx, r)
+
+			a.mu.Lock()
+			a.merge(fagg.solution)
+			a.mu.Unlock()
+			a.rows.Add(fagg.Rows())
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
 }
 
-func solve1brc(filename string) error {
-	f, err := os.Open(filename)
+// With -strict-spec files must end with the separator, instead of having it
+// added by terminatedReader. The line of the error is counted within the file.
+func checkTerminated(f *os.File, sep byte) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 || !info.Mode().IsRegular() {
+		return nil // a stream is checked once it ends, by AddReaderContext
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == sep {
+		return nil
+	}
+
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, info.Size()))
 	if err != nil {
 		return err
 	}
+	i := bytes.LastIndexByte(b, sep)
+	return &ParseError{
+		Line:   int64(bytes.Count(b, []byte{sep})) + 1,
+		Text:   string(b[i+1:]),
+		Reason: fmt.Sprintf("last line of %s is not terminated", f.Name()),
+	}
+}
+
+// Files read back to back must not glue the unterminated last line of one to
+// the first line of the next, so terminate it when missing.
+func terminatedReader(f *os.File, sep byte) (io.Reader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 || !info.Mode().IsRegular() {
+		return f, nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return nil, err
+	}
+	if last[0] == sep {
+		return f, nil
+	}
+	return io.MultiReader(f, bytes.NewReader([]byte{sep})), nil
+}
+
+// AddReader folds every record of r into the aggregator. It can be called
+// several times, calls are serialized and continue the same logical stream:
+// only the very first reader can start with a byte order mark or a header,
+// and rows keep counting across readers.
+func (a *Aggregator) AddReader(r io.Reader) error {
+	return a.AddReaderContext(context.Background(), r)
+}
+
+// AddReaderContext is AddReader stopping to read once the context is done,
+// returning its error. The chunks read until then are still aggregated.
+func (a *Aggregator) AddReaderContext(ctx context.Context, r io.Reader) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.opts.spill > 0 && a.spillDir == "" {
+		dir, err := os.MkdirTemp("", "1brc-spill-")
+		if err != nil {
+			return err
+		}
+		a.spillDir = dir
+	}
 
+	readBufferPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(readBufferPtr)
 	var (
-		readBuffer    = make([]byte, readBufferSize)
-		wg            = sync.WaitGroup{}
-		solutions     = make([]map[string]*solutionItem, workerNum)
+		opts          = a.opts
+		workerNum     = resolveWorkers(opts.workers, -1)
+		readBuffer    = *readBufferPtr
 		workerBuffers = make([][]byte, workerNum)
 		toProcess     = make(chan *workItem, workerNum+1)
 		doneProcess   = make(chan int, workerNum+1)
+		results       = make(chan *parser, workerNum)
+
+		// closed by a worker stopping before there is no more work, so the
+		// reader never waits on a buffer it will not hand back
+		stopped     = make(chan struct{})
+		stoppedOnce sync.Once
 	)
 
+	// buffers are a pool handed over to whichever worker is free, while each
+	// worker owns its solution and hands it over once there is no more work
 	for n := range workerNum {
-		solutions[n] = make(map[string]*solutionItem)
-		workerBuffers[n] = make([]byte, readBufferSize)
+		b := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(b) // only once every worker is done
+		workerBuffers[n] = *b
 		doneProcess <- n // signal ready
 
-		wg.Add(1)
 		go func() {
-			defer wg.Done()
-			for {
-				item, ok := <-toProcess
-				if !ok {
-					return
+			p := newParser(opts)
+			p.spillDir, p.spillAt = a.spillDir, opts.spill
+			var subs []*parser // with -subworkers each chunk is split among these
+			for range opts.subworkers - 1 {
+				subs = append(subs, newParser(opts))
+			}
+			done := false
+			defer func() {
+				// the chunks recover on their own, this is for anything else
+				if r := recover(); r != nil {
+					p.err = &internalError{panic: r, stack: debug.Stack()}
+				}
+				if !done {
+					stoppedOnce.Do(func() { close(stopped) })
+				}
+				if p.err == nil {
+					p.maybeSpill(true) // everything ends up in runs when spilling
+				}
+				results <- p
+			}()
+			for item := range toProcess {
+				if len(opts.percentiles) > 0 {
+					// a stream of its own, apart from the one of -sample
+					p.rng = rand.New(rand.NewPCG(^opts.seed, item.chunk))
+					for k, sub := range subs {
+						sub.rng = rand.New(rand.NewPCG(^(opts.seed + uint64(k) + 1), item.chunk))
+					}
+				}
+				if opts.sample < 1 {
+					// seeded by chunk so the sample does not depend on which
+					// worker picked up the chunk
+					p.smp = &sampler{p: opts.sample, rng: rand.New(rand.NewPCG(opts.seed, item.chunk))}
+					for k, sub := range subs {
+						sub.smp = &sampler{p: opts.sample, rng: rand.New(rand.NewPCG(opts.seed+uint64(k)+1, item.chunk))}
+					}
 				}
-				b := workerBuffers[item.bufferIndex][:item.bufferLen]
-				processBuffer(b, solutions[item.bufferIndex])
+				if p.err != nil {
+					doneProcess <- item.bufferIndex // keep draining, the error is reported at the end
+					continue
+				}
+				if testHookChunk != nil {
+					testHookChunk()
+				}
+				p.row = item.firstRow
+				rows := p.rows
+				p.processChunk(workerBuffers[item.bufferIndex][:item.bufferLen], subs)
+				a.rows.Add(p.rows - rows) // a single atomic add per chunk
+				p.maybeSpill(false)
 				doneProcess <- item.bufferIndex
 			}
-
+			done = true
 		}()
 	}
+	// the chunk is the concatenation of the pieces
+	dispatch := func(pieces ...[]byte) bool {
+		var i int
+		select {
+		case i = <-doneProcess:
+		case <-stopped:
+			return false
+		}
+		n := 0
+		for _, b := range pieces {
+			n += copy(workerBuffers[i][n:], b) // copy data
+		}
+		toProcess <- &workItem{bufferIndex: i, bufferLen: n, chunk: a.chunk, firstRow: a.row} // signal worker
+		a.chunk++
+		if opts.trackRows() {
+			for _, b := range pieces {
+				a.row += int64(bytes.Count(b, []byte{opts.recordSep}))
+			}
+		}
+		a.bytes += int64(n)
+		if a.progress != nil {
+			a.progress(Progress{Chunks: a.chunk, Bytes: a.bytes, Rows: a.rows.Load()})
+		}
+		return true
+	}
+
 	remain := 0
+	firstRead := !a.started
+	skipHeader := opts.header && !a.started
+	a.started = true
+
+	// with an index the reads stop right at the chunk boundaries, so the
+	// scan back for the last line break ends right away
+	boundaries := a.boundaries
+	a.boundaries = nil
+	consumed := int64(0)
+
+	// a partial line must leave room in the buffer for the next read
+	maxLineLen := len(readBuffer) - 1
+	if opts.maxLineLen > 0 {
+		maxLineLen = min(maxLineLen, opts.maxLineLen)
+	}
+
+	// with -warn-on-slow-read only the time blocked in Read counts, waiting
+	// for a free worker is the parsing being the bottleneck instead
+	var (
+		windowStart = time.Now()
+		readTime    time.Duration
+		readBytes   int64
+	)
 
-	log.Printf("starting to read file %s by chunks of %v bytes\n", filename, readBufferSize)
+	// with -no-carry-copy the partial line at the end of a read is left where
+	// it is and the next read goes to the other buffer, the two are only
+	// joined by the copy into the worker buffer. The carry is only kept apart
+	// once past the byte order mark and the header.
+	var spare, carry []byte
+	if opts.noCarryCopy {
+		spareBufferPtr := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(spareBufferPtr)
+		spare = *spareBufferPtr
+	}
+
+	// a Read can return bytes along with its error, io.EOF included, the
+	// bytes are processed first and the error is taken on the next round
+	var pending error
+
+	var err error
 	for {
-		n, err := f.Read(readBuffer[remain:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
+		if ctx.Err() != nil {
+			err = context.Cause(ctx) // errTerminated on SIGTERM
+			break
+		}
+		end := len(readBuffer)
+		for len(boundaries) > 0 && boundaries[0] <= consumed {
+			boundaries = boundaries[1:]
+		}
+		if len(boundaries) > 0 && remain+int(boundaries[0]-consumed) < end {
+			end = remain + int(boundaries[0]-consumed)
+		}
+		dst := readBuffer[remain:end]
+		if carry != nil {
+			dst = readBuffer[:end-remain]
+		}
+		var (
+			n    int
+			rerr error
+		)
+		readStart := time.Now()
+		if pending != nil {
+			rerr, pending = pending, nil
+		} else if n, rerr = r.Read(dst); n > 0 && rerr != nil {
+			pending, rerr = rerr, nil
+		}
+		consumed += int64(n)
+		if opts.warnOnSlowRead > 0 {
+			readTime += time.Since(readStart)
+			readBytes += int64(n)
+			if time.Since(windowStart) >= slowReadWindow {
+				if mibs := float64(readBytes) / (1 << 20) / readTime.Seconds(); mibs < opts.warnOnSlowRead {
+					slog.Warn("reading the input is slow, it is the bottleneck", "mib_per_second", math.Round(mibs*100)/100, "threshold", opts.warnOnSlowRead)
+				}
+				windowStart, readTime, readBytes = time.Now(), 0, 0
+			}
+		}
+		if rerr != nil {
+			if ctx.Err() != nil {
+				err = context.Cause(ctx) // the read was cut short by closing the file
+			} else if !errors.Is(rerr, io.EOF) {
+				err = rerr
+			} else if remain > 0 && opts.strictSpec {
+				line := a.row + 1 // rows are only counted before the header
+				if opts.header {
+					line++
+				}
+				partial := readBuffer[:remain]
+				if carry != nil {
+					partial = carry
+				}
+				err = &ParseError{Line: line, Text: string(partial), Reason: "last line is not terminated"}
+			} else if remain > 0 && carry != nil {
+				if !dispatch(carry, []byte{opts.recordSep}) {
+					err = errWorkerStopped
+				}
+			} else if remain > 0 {
+				// the last line is not terminated, terminate it so it is not lost
+				readBuffer[remain] = opts.recordSep
+				if !dispatch(readBuffer[:remain+1]) {
+					err = errWorkerStopped
+				}
+			}
+			break
+		}
+
+		if carry != nil {
+			// the partial line is still in the other buffer, only the bytes
+			// just read are in this one
+			li := bytes.LastIndexByte(readBuffer[:n], opts.recordSep)
+			if li < 0 {
+				// still no line break, the line is joined in this buffer
+				// until it shows up, as without -no-carry-copy
+				if remain+n > maxLineLen {
+					err = fmt.Errorf("found a line longer than the -max-line-len of %d bytes without a terminator", maxLineLen)
+					break
+				}
+				copy(readBuffer[remain:], readBuffer[:n])
+				copy(readBuffer, carry)
+				remain += n
+				carry = nil
+				continue
+			}
+			if !dispatch(carry, readBuffer[:li+1]) {
+				err = errWorkerStopped
 				break
 			}
-			return err
+			remain = n - li - 1
+			if remain > maxLineLen {
+				err = fmt.Errorf("found a line longer than the -max-line-len of %d bytes without a terminator", maxLineLen)
+				break
+			}
+			carry = nil
+			if remain > 0 {
+				carry = readBuffer[li+1 : n]
+				readBuffer, spare = spare, readBuffer
+			}
+			continue
 		}
 
 		blen := remain + n // buffer len after read
-		li := blen - 1     // last line break index
-		for {
-			if readBuffer[li] == '\n' {
-				break
+		// the carried over partial line has no line break, short reads only
+		// scan the bytes they added so a long line read byte by byte
+		// accumulates linearly until its line break shows up
+		scanFrom := remain
+		if firstRead {
+			// a byte order mark can only be at the absolute start of the file,
+			// the carry over never brings the file start here again
+			if blen < len(utf8BOM) && bytes.HasPrefix(utf8BOM, readBuffer[:blen]) {
+				remain = blen // a short read, wait for the rest of the mark
+				continue
 			}
+			firstRead = false
+			if bytes.HasPrefix(readBuffer[:blen], utf8BOM) {
+				blen = copy(readBuffer, readBuffer[len(utf8BOM):blen])
+				scanFrom = 0
+			}
+		}
+		if skipHeader {
+			// only the very first line of the stream is a header, drop it
+			// before any chunk is dispatched to the workers
+			hi := bytes.IndexByte(readBuffer[:blen], opts.recordSep)
+			if hi < 0 {
+				remain = 0 // the header is longer than this read, keep discarding
+				continue
+			}
+			skipHeader = false
+			blen = copy(readBuffer, readBuffer[hi+1:blen])
+			scanFrom = 0
+		}
+		if blen == 0 {
+			remain = 0
+			continue
+		}
+		li := blen - 1 // last line break index, -1 when there is none yet
+		for li >= scanFrom && readBuffer[li] != opts.recordSep {
 			li--
 		}
+		if li < scanFrom {
+			li = -1
+		}
 
-		i := <-doneProcess
-		copy(workerBuffers[i][:li], readBuffer[:li])          // copy data
-		toProcess <- &workItem{bufferIndex: i, bufferLen: li} // signal worker
-		remain = blen - li - 1                                // carry over last partial line and continue reading
-		if remain > 0 {
+		if li >= 0 && !dispatch(readBuffer[:li+1]) { // up to and including the last line break
+			err = errWorkerStopped
+			break
+		}
+		remain = blen - li - 1 // carry over last partial line and continue reading
+		if remain > maxLineLen {
+			err = fmt.Errorf("found a line longer than the -max-line-len of %d bytes without a terminator", maxLineLen)
+			break
+		}
+		if remain > 0 && li >= 0 && spare != nil {
+			carry = readBuffer[li+1 : blen]
+			readBuffer, spare = spare, readBuffer
+		} else if remain > 0 && li >= 0 {
 			copy(readBuffer[:remain], []byte(readBuffer[li+1:blen]))
 		}
 	}
 
 	close(toProcess)
-	wg.Wait()
 
-	printSolutions(solutions)
+	for range workerNum {
+		p := <-results
+		if p.err != nil && err == errWorkerStopped {
+			err = p.err // the reason the worker stopped, if it left one
+		}
+		err = earliestError(err, p.err)
+		if opts.unique {
+			err = earliestError(err, a.checkUnique(p.solution, p.lineBase))
+		}
+		a.merge(p.solution)
+		a.runs = append(a.runs, p.runs...)
+	}
+	select {
+	case <-stopped:
+		// its chunk is lost even when the reader finished without noticing
+		if err == nil {
+			err = errWorkerStopped
+		}
+	default:
+	}
+	return err
+}
+
+// Solve and print the results. Partial results of -best-effort are printed
+// too, but their error is still returned.
+func solveAndPrint(ctx context.Context, a args) error {
+	agg, solveErr := solve1brc(ctx, a)
+	if agg == nil {
+		return solveErr
+	}
+	defer agg.Close()
+	if a.failOnEmpty && solveErr == nil && agg.Rows() == 0 {
+		return errEmptyInput
+	}
+	if a.countHist != "" {
+		if err := writeCountHist(a.countHist, agg); err != nil {
+			return errors.Join(solveErr, err)
+		}
+	}
+	if solveErr != nil {
+		slog.Warn("printing partial results", "err", solveErr)
+		// marked in the output too, -merge-only skips the marker
+		return errors.Join(solveErr, writeOutput(a, func(w io.Writer) error {
+			fmt.Fprintf(w, "# partial results: %v\n", solveErr)
+			return errors.Join(printSolutions(w, agg, a), agg.Err())
+		}))
+	}
+	return printResults(agg, a)
+}
+
+// Cancel the context on SIGTERM with errTerminated as its cause, so that a
+// preempted run stops reading, drains its workers and still prints what was
+// aggregated so far.
+func cancelOnSigterm(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sig:
+			slog.Warn("received SIGTERM, stopping")
+			cancel(errTerminated)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sig)
+		cancel(nil)
+	}
+}
+
+// Write how many stations have 1-9 readings, 10-99, 100-999 and so on, one
+// bucket per line up to the largest count. Every station is counted, the
+// output filters do not apply.
+func writeCountHist(path string, agg *Aggregator) error {
+	var buckets []int
+	agg.ForEachSorted(func(s StationStats) {
+		b := 0
+		for c := s.Count; c >= 10; c /= 10 {
+			b++
+		}
+		for len(buckets) <= b {
+			buckets = append(buckets, 0)
+		}
+		buckets[b]++
+	})
+	if err := agg.Err(); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	lo := 1
+	for _, n := range buckets {
+		fmt.Fprintf(w, "%d-%d %d\n", lo, lo*10-1, n)
+		lo *= 10
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Print the results to the -o file, or stdout. The output is buffered and
+// written out every time the buffer fills up, so consumers start reading the
+// first stations while the last ones are still being formatted. With -stream
+// every station is flushed as soon as it is merged instead.
+func printResults(agg *Aggregator, a args) error {
+	return writeOutput(a, func(w io.Writer) error {
+		return errors.Join(printSolutions(w, agg, a), agg.Err())
+	})
+}
+
+// Hand fn a buffered writer to the -o file, the -shard-output files, or
+// stdout, and flush it after.
+func writeOutput(a args, fn func(w io.Writer) error) error {
+	if a.shardOutput != "" {
+		w, err := newShardWriter(a)
+		if err != nil {
+			return err
+		}
+		return errors.Join(fn(w), w.Close())
+	}
+	if a.output == "" {
+		w := bufio.NewWriterSize(os.Stdout, a.outputBufferSize)
+		return errors.Join(fn(w), w.Flush())
+	}
+	f, err := os.Create(a.output)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, a.outputBufferSize)
+	if err := errors.Join(fn(w), w.Flush()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Run the full solve the given number of times, discarding the results, and
+// report the wall time of each run and their summary to stderr.
+func benchmark(ctx context.Context, a args, runs int) error {
+	timings := make([]time.Duration, 0, runs)
+	for r := range runs {
+		start := time.Now()
+		agg, err := solve1brc(ctx, a)
+		if agg != nil {
+			agg.Close()
+		}
+		if err != nil {
+			return err
+		}
+		t := time.Since(start)
+		timings = append(timings, t)
+		fmt.Fprintf(os.Stderr, "run %d: %v\n", r+1, t)
+	}
+
+	slices.Sort(timings)
+	var total time.Duration
+	for _, t := range timings {
+		total += t
+	}
+	median := timings[runs/2]
+	if runs%2 == 0 {
+		median = (timings[runs/2-1] + timings[runs/2]) / 2
+	}
+	fmt.Fprintf(os.Stderr, "min=%v median=%v max=%v mean=%v\n", timings[0], median, timings[runs-1], total/time.Duration(runs))
 	return nil
 }
 
+// Set the soft memory limit of the runtime, returning the function that
+// restores the previous one.
+func setMemoryLimit(bytes int64) (restore func()) {
+	prev := debug.SetMemoryLimit(bytes)
+	slog.Debug("set the memory limit", "bytes", bytes)
+	return func() { debug.SetMemoryLimit(prev) }
+}
+
 func main() {
-	defer panicHandler()
+	os.Exit(run())
+}
+
+// Run the executable returning its exit code, so that every deferred cleanup
+// happens before exiting.
+func run() (code int) {
+	defer panicHandler(&code)
 
 	a, err := parseArgs()
-	gracefullyHanldeErrors(err)
+	if err != nil {
+		return gracefullyHanldeErrors(err)
+	}
+	if a.version {
+		printVersion(os.Stdout)
+		return exitOK
+	}
+	slog.SetDefault(newLogger(a))
+	if a.maxMemory > 0 {
+		defer setMemoryLimit(a.maxMemory)()
+	}
+	// -workers auto never goes past the CPUs, only a fixed count does, and
+	// -strict-order uses none
+	if cpus := runtime.NumCPU(); a.workers > cpus && !a.quiet && !a.strictOrder {
+		slog.Warn("more workers than CPUs, they will compete for them, consider -workers auto or a lower -workers", "workers", a.workers, "cpus", cpus)
+	}
+
+	if a.dryRun {
+		return gracefullyHanldeErrors(dryRun(a))
+	}
 
 	if a.profile {
 		f, err := os.Create("cpu-" + time.Now().Format(time.RFC3339) + ".prof")
 		if err != nil {
-			gracefullyHanldeErrors(err)
+			return gracefullyHanldeErrors(err)
 		}
 		defer func() {
 			err = f.Close()
 			if err != nil {
-				log.Printf("[ERROR] %v\n", err)
+				slog.Error(err.Error())
 			}
 		}()
 		if err := pprof.StartCPUProfile(f); err != nil {
-			log.Printf("[ERROR] could not start cpu profile %v\n", err)
+			slog.Error("could not start cpu profile", "err", err)
+		}
+		stop := sync.OnceFunc(pprof.StopCPUProfile)
+		defer stop()
+		if a.profileDuration > 0 {
+			t := time.AfterFunc(a.profileDuration, func() {
+				stop()
+				slog.Info("stopped the cpu profile", "after", a.profileDuration)
+			})
+			defer t.Stop()
 		}
-		defer pprof.StopCPUProfile()
 
 	}
 
-	err = solve1brc(a.filename)
-	gracefullyHanldeErrors(err)
+	if a.trace {
+		f, err := os.Create("trace-" + time.Now().Format(time.RFC3339) + ".out")
+		if err != nil {
+			return gracefullyHanldeErrors(err)
+		}
+		defer func() {
+			err = f.Close()
+			if err != nil {
+				slog.Error(err.Error())
+			}
+		}()
+		if err := trace.Start(f); err != nil {
+			slog.Error("could not start execution trace", "err", err)
+		}
+		defer trace.Stop()
+	}
+
+	if a.buildIndex {
+		return gracefullyHanldeErrors(buildIndex(a.filename, a.recordSep))
+	}
+
+	if a.mergeOnly {
+		agg, err := mergeResults(a)
+		if err != nil {
+			return gracefullyHanldeErrors(err)
+		}
+		return gracefullyHanldeErrors(printResults(agg, a))
+	}
+
+	if a.peek > 0 {
+		return gracefullyHanldeErrors(writeOutput(a, func(w io.Writer) error {
+			return peek(a, a.peek, w)
+		}))
+	}
+
+	ctx := context.Background()
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	ctx, stop := cancelOnSigterm(ctx)
+	defer stop()
+
+	if a.strictOrder {
+		return gracefullyHanldeErrors(writeOutput(a, func(w io.Writer) error {
+			return solveStrictOrder(ctx, a, w)
+		}))
+	}
+
+	if a.compare != "" {
+		return gracefullyHanldeErrors(writeOutput(a, func(w io.Writer) error {
+			return compareResults(ctx, a, w)
+		}))
+	}
+
+	if a.shuffleCheck {
+		return gracefullyHanldeErrors(shuffleCheck(ctx, a))
+	}
+
+	if a.benchRuns > 0 {
+		return gracefullyHanldeErrors(benchmark(ctx, a, a.benchRuns))
+	}
+
+	if a.watch {
+		return gracefullyHanldeErrors(watch(ctx, a, watchPollInterval, watchDebounce))
+	}
+
+	if a.cache {
+		return gracefullyHanldeErrors(solveAndPrintCached(ctx, a))
+	}
+
+	return gracefullyHanldeErrors(solveAndPrint(ctx, a))
 }
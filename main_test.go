@@ -0,0 +1,1947 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// With BRC_TEST_MAIN set the test binary runs the executable instead, so the
+// tests can check its output and exit codes.
+func TestMain(m *testing.M) {
+	if os.Getenv("BRC_TEST_MAIN") == "1" {
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		if os.Getenv("BRC_TEST_PANIC") == "1" {
+			// a fault of the program rather than of its input
+			testHookChunk = func() { panic("injected by BRC_TEST_PANIC") }
+		}
+		os.Exit(run())
+	}
+	os.Exit(m.Run())
+}
+
+// Run the executable with args and stdin, returning its stdout, stderr and
+// exit code.
+func run1brc(t *testing.T, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "BRC_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// Solve the input with args, failing the test unless it exits cleanly, and
+// return its stdout.
+func solveArgs(t *testing.T, input string, args ...string) string {
+	t.Helper()
+	args = append([]string{"-quiet", "-log-level", "error"}, args...)
+	stdout, stderr, code := run1brc(t, "", append(args, writeInput(t, input))...)
+	if code != exitOK {
+		t.Fatalf("exit code %d, stderr %q", code, stderr)
+	}
+	return stdout
+}
+
+// Write the input to a file in a new directory, returning its path.
+func writeInput(t *testing.T, input string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The merged stations of agg as name=min/mean/max (count), one per line.
+func summary(t *testing.T, agg *Aggregator) string {
+	t.Helper()
+	stats, err := agg.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, s := range stats {
+		fmt.Fprintf(&b, "%s=%.1f/%.1f/%.1f (%d)\n", s.Name, s.Min, s.Mean, s.Max, s.Count)
+	}
+	return b.String()
+}
+
+// Aggregate input with opts, failing the test on any error.
+func aggregate(t *testing.T, opts args, r io.Reader) *Aggregator {
+	t.Helper()
+	agg := newAggregator(opts)
+	t.Cleanup(func() { agg.Close() })
+	if err := agg.AddReader(r); err != nil {
+		t.Fatal(err)
+	}
+	return agg
+}
+
+// A reader returning each chunk from a Read of its own, the last one along
+// with io.EOF.
+type chunkReader []string
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	if len(*c) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, (*c)[0])
+	if n < len((*c)[0]) {
+		(*c)[0] = (*c)[0][n:]
+		return n, nil
+	}
+	*c = (*c)[1:]
+	if len(*c) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestAddReaderDataWithEOF(t *testing.T) {
+	want := "A=1.0/1.0/1.0 (1)\nB=2.0/2.0/2.0 (1)\nC=3.0/3.0/3.0 (1)\n"
+	for name, r := range map[string]io.Reader{
+		"single read":   iotest.DataErrReader(strings.NewReader("A;1.0\nB;2.0\nC;3.0\n")),
+		"carried line":  &chunkReader{"A;1.0\nB;2", ".0\nC;3.0\n"},
+		"unterminated":  &chunkReader{"A;1.0\nB;2.0\n", "C;3.0"},
+		"one byte":      iotest.DataErrReader(iotest.OneByteReader(strings.NewReader("A;1.0\nB;2.0\nC;3.0\n"))),
+		"empty at last": &chunkReader{"A;1.0\nB;2.0\nC;3.0\n", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			agg := aggregate(t, defaultArgs(), r)
+			if got := summary(t, agg); got != want {
+				t.Errorf("got\n%swant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestUniqueReportsEarliestRepeat(t *testing.T) {
+	// two repeats, the first one within the first chunk and the second one
+	// chunks later, whichever worker gets there first
+	var b strings.Builder
+	for i := range 600_000 {
+		switch i {
+		case 40:
+			b.WriteString("s0;2.0\n")
+		case 500_000:
+			b.WriteString("s7;2.0\n")
+		default:
+			fmt.Fprintf(&b, "s%d;1.0\n", i)
+		}
+	}
+	input := b.String()
+	for _, tc := range []struct{ workers, subworkers int }{{1, 1}, {4, 1}, {1, 4}, {4, 3}} {
+		t.Run(fmt.Sprintf("workers=%d,subworkers=%d", tc.workers, tc.subworkers), func(t *testing.T) {
+			opts := defaultArgs()
+			opts.unique = true
+			opts.workers, opts.subworkers = tc.workers, tc.subworkers
+			agg := newAggregator(opts)
+			err := agg.AddReader(strings.NewReader(input))
+			var pe *ParseError
+			if !errors.As(err, &pe) || pe.Line != 41 {
+				t.Fatalf("got %v, want the repeat of s0 on line 41", err)
+			}
+		})
+	}
+}
+
+func TestUniqueAcrossSubworkers(t *testing.T) {
+	var b strings.Builder
+	for i := range 1000 {
+		fmt.Fprintf(&b, "s%d;1.0\n", i)
+	}
+	b.WriteString("s3;2.0\n")
+	opts := defaultArgs()
+	opts.unique = true
+	opts.workers, opts.subworkers = 1, 4
+	err := newAggregator(opts).AddReader(strings.NewReader(b.String()))
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 1001 {
+		t.Fatalf("got %v, want the repeat of s3 on line 1001", err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	a := defaultArgs()
+	a.filename = writeInput(t, "\xEF\xBB\xBFstation;temp\nParis;12.3\nOslo;-4.0\nParis;14.1\n")
+	a.header = true
+	var b strings.Builder
+	if err := peek(a, 2, &b); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%-30s %5.1f\n%-30s %5.1f\n", "Paris", 12.3, "Oslo", -4.0)
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestPeekOutput(t *testing.T) {
+	input := writeInput(t, "Paris;12.3\nOslo;-4.0\n")
+	output := filepath.Join(t.TempDir(), "peek.txt")
+	stdout, stderr, code := run1brc(t, "", "-quiet", "-peek", "5", "-o", output, input)
+	if code != exitOK || stdout != "" {
+		t.Fatalf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%-30s %5.1f\n%-30s %5.1f\n", "Paris", 12.3, "Oslo", -4.0); string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+func TestMaxLineLen(t *testing.T) {
+	opts := defaultArgs()
+	opts.maxLineLen = 16
+	long := strings.Repeat("x", 40)
+	for name, r := range map[string]io.Reader{
+		"unterminated": strings.NewReader("A;1.0\n" + long),
+		"carried":      &chunkReader{"A;1.0\n" + long[:20], long[20:], ";1.0\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := newAggregator(opts).AddReader(r)
+			if err == nil || !strings.Contains(err.Error(), "-max-line-len of 16 bytes") {
+				t.Fatalf("got %v, want the -max-line-len error", err)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	// a sparse file a byte longer than two buffers, read as three chunks
+	path := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 2*readBufferSize+1); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := run1brc(t, "", "-quiet", "-workers", "2", "-dry-run", path)
+	if code != exitOK || stdout != "" {
+		t.Fatalf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("file size:   %d bytes\n", 2*readBufferSize+1),
+		"workers:     2\n",
+		"chunks:      3\n",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("got %q, want it to hold %q", stderr, want)
+		}
+	}
+}
+
+func TestForEachSorted(t *testing.T) {
+	// past a few chunks, so that every worker holds all the stations
+	var b strings.Builder
+	for b.Len() < 3*readBufferSize {
+		b.WriteString("Paris;12.3\nOslo;-4.0\nAbidjan;31.0\nParis;14.1\n")
+	}
+	rows := strings.Count(b.String(), "\n") / 4
+	opts := defaultArgs()
+	opts.workers = 4
+	agg := aggregate(t, opts, strings.NewReader(b.String()))
+	var got []StationStats
+	agg.ForEachSorted(func(s StationStats) { got = append(got, s) })
+	want := []StationStats{
+		{Name: "Abidjan", Min: 31, Mean: 31, Max: 31, Count: rows},
+		{Name: "Oslo", Min: -4, Mean: -4, Max: -4, Count: rows},
+		{Name: "Paris", Min: 12.3, Mean: 13.2, Max: 14.1, Count: 2 * rows},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Name != w.Name || g.Min != w.Min || g.Mean != w.Mean || g.Max != w.Max || g.Count != w.Count {
+			t.Errorf("got %v, want %v", g, w)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	opts := defaultArgs()
+	opts.header = true
+	want := "Oslo=-4.0/-4.0/-4.0 (1)\nParis=12.3/12.3/12.3 (1)\n"
+	for name, r := range map[string]io.Reader{
+		"one read":   strings.NewReader("station;temp\nParis;12.3\nOslo;-4.0\n"),
+		"split":      &chunkReader{"stat", "ion;te", "mp\nParis;12.3\nOslo;-4.0\n"},
+		"byte apart": iotest.OneByteReader(strings.NewReader("station;temp\nParis;12.3\nOslo;-4.0\n")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := summary(t, aggregate(t, opts, r)); got != want {
+				t.Errorf("got\n%swant\n%s", got, want)
+			}
+		})
+	}
+	if got := summary(t, aggregate(t, opts, strings.NewReader("station;temp\n"))); got != "" {
+		t.Errorf("got %q from the header alone", got)
+	}
+}
+
+func TestHeaderOfFirstFile(t *testing.T) {
+	a := defaultArgs()
+	a.header = true
+	a.filenames = []string{writeInput(t, "station;temp\nParis;12.3\n"), writeInput(t, "Oslo;-4.0\n")}
+	a.filename = a.filenames[0]
+	agg, err := solve1brc(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agg.Close()
+	if got, want := summary(t, agg), "Oslo=-4.0/-4.0/-4.0 (1)\nParis=12.3/12.3/12.3 (1)\n"; got != want {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	bom := string(utf8BOM)
+	want := "Oslo=-4.0/-4.0/-4.0 (1)\nParis=12.3/12.3/12.3 (1)\n"
+	for name, r := range map[string]io.Reader{
+		"one read": strings.NewReader(bom + "Paris;12.3\nOslo;-4.0\n"),
+		"split":    &chunkReader{bom[:1], bom[1:] + "Paris;12.3\nOslo;-4.0\n"},
+		"one byte": iotest.OneByteReader(strings.NewReader(bom + "Paris;12.3\nOslo;-4.0\n")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := summary(t, aggregate(t, defaultArgs(), r)); got != want {
+				t.Errorf("got\n%swant\n%s", got, want)
+			}
+		})
+	}
+	// only at the start of the file
+	r := strings.NewReader("Paris;12.3\n" + bom + "Oslo;-4.0\n")
+	if got, want := summary(t, aggregate(t, defaultArgs(), r)), "Paris=12.3/12.3/12.3 (1)\n"+bom+"Oslo=-4.0/-4.0/-4.0 (1)\n"; got != want {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+}
+
+func TestSample(t *testing.T) {
+	input := strings.Repeat("Paris;12.3\n", 100_000)
+	count := func(seed uint64) int {
+		opts := defaultArgs()
+		opts.workers = 1
+		opts.sample, opts.seed = 0.25, seed
+		stats, err := aggregate(t, opts, strings.NewReader(input)).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats[0].Count
+	}
+	first := count(1)
+	if first < 24_000 || first > 26_000 {
+		t.Errorf("kept %d rows of 100000 with -sample 0.25", first)
+	}
+	if again := count(1); again != first {
+		t.Errorf("kept %d and then %d rows with the same seed", first, again)
+	}
+	if other := count(2); other == first {
+		t.Errorf("kept %d rows with either seed", first)
+	}
+
+	// every row at 1, none at 0
+	mixed := string(genMeasurements(200_000, genNames(100, 3, 20)))
+	if got, want := solveArgs(t, mixed, "-sample", "1"), solveArgs(t, mixed); got != want {
+		t.Error("the results with -sample 1 differ from the full aggregation")
+	}
+	if got := solveArgs(t, mixed, "-sample", "0"); got != "" {
+		t.Errorf("-sample 0 printed %d bytes", len(got))
+	}
+	opts := defaultArgs()
+	opts.sample = 0
+	if stats, err := aggregate(t, opts, strings.NewReader(mixed)).Result(); err != nil || len(stats) != 0 {
+		t.Errorf("-sample 0 counted %d stations, %v", len(stats), err)
+	}
+}
+
+// The merged stations of agg as name=min/max (count), the means aside as
+// the order of the float sums depends on the workers.
+func extremes(t *testing.T, agg *Aggregator) string {
+	t.Helper()
+	stats, err := agg.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, s := range stats {
+		fmt.Fprintf(&b, "%s=%.1f/%.1f (%d)\n", s.Name, s.Min, s.Max, s.Count)
+	}
+	return b.String()
+}
+
+func TestWorkersAgree(t *testing.T) {
+	input := genMeasurements(2_000_000, genNames(500, 3, 20))
+	opts := defaultArgs()
+	opts.workers = 1
+	want := extremes(t, aggregate(t, opts, bytes.NewReader(input)))
+	for _, workers := range []int{2, 8, 32} {
+		opts.workers = workers
+		if got := extremes(t, aggregate(t, opts, bytes.NewReader(input))); got != want {
+			t.Errorf("-workers %d disagrees with -workers 1", workers)
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	// a station at the first row, at the last one and once within every
+	// chunk, so the row indices must be counted across the workers
+	var b strings.Builder
+	b.WriteString("First;1.0\n")
+	rows := 1
+	for b.Len() < 3*readBufferSize {
+		b.WriteString("Filler;1.0\n")
+		rows++
+	}
+	b.WriteString("Last;2.0\nFirst;3.0\n")
+	rows += 2
+	opts := defaultArgs()
+	opts.workers = 4
+	opts.provenance = true
+	stats, err := aggregate(t, opts, strings.NewReader(b.String())).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]int64{
+		"Filler": {1, int64(rows) - 3},
+		"First":  {0, int64(rows) - 1},
+		"Last":   {int64(rows) - 2, int64(rows) - 2},
+	}
+	for _, s := range stats {
+		if got := [2]int64{s.FirstRow, s.LastRow}; got != want[s.Name] {
+			t.Errorf("%s: got rows %v, want %v", s.Name, got, want[s.Name])
+		}
+	}
+}
+
+func TestParseSeparator(t *testing.T) {
+	for v, want := range map[string]byte{`\0`: 0, "|": '|', `\t`: '\t', `\x1e`: 0x1E} {
+		if got, err := parseSeparator(v); err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"", "ab", `Ā`} {
+		if _, err := parseSeparator(v); err == nil {
+			t.Errorf("%q: got no error", v)
+		}
+	}
+}
+
+func TestRecordSep(t *testing.T) {
+	opts := defaultArgs()
+	opts.recordSep = 0
+	// the newline is part of the name, and the last record is unterminated
+	r := &chunkReader{"A;1.0\x00B\n;2", ".0\x00A;3.0"}
+	if got, want := summary(t, aggregate(t, opts, r)), "A=1.0/2.0/3.0 (2)\nB\n=2.0/2.0/2.0 (1)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	stdout, stderr, code := run1brc(t, "", "-quiet", "-record-sep", ";", writeInput(t, "A;1.0\n"))
+	if code != exitIOError || stdout != "" {
+		t.Errorf("-record-sep ';': exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+}
+
+func TestBench(t *testing.T) {
+	stdout, stderr, code := run1brc(t, "", "-quiet", "-log-level", "error", "-bench", "3", writeInput(t, "Paris;12.3\n"))
+	if code != exitOK || stdout != "" {
+		t.Fatalf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	lines := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %q, want a line per run and the summary", stderr)
+	}
+	for i, line := range lines[:3] {
+		if !strings.HasPrefix(line, fmt.Sprintf("run %d: ", i+1)) {
+			t.Errorf("got %q for run %d", line, i+1)
+		}
+	}
+	if !strings.HasPrefix(lines[3], "min=") || !strings.Contains(lines[3], " median=") {
+		t.Errorf("got summary %q", lines[3])
+	}
+}
+
+func TestFormatTenths(t *testing.T) {
+	for v, want := range map[float64]string{
+		0: "0.0", math.Copysign(0, -1): "0.0", -0.04: "0.0", -0.05: "-0.1",
+		-0.1: "-0.1", 12.34: "12.3", -99.9: "-99.9", 99.95: "100.0",
+	} {
+		if got := formatTenths(v); got != want {
+			t.Errorf("formatTenths(%v) = %q, want %q", v, got, want)
+		}
+	}
+	if got := solveArgs(t, "A;-0.1\nA;0.0\nA;0.0\n"); got != "A=-0.1/0.0/0.0\n" {
+		t.Errorf("got %q, want a mean of 0.0 rather than -0.0", got)
+	}
+}
+
+func TestIncludeExclude(t *testing.T) {
+	input := "Paris;12.3\nOslo;-4.0\nRome;20.0\nLima;18.0\n"
+	list := writeInput(t, "Rome\nOslo\n\n")
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-include", "Paris,Rome"}, "Paris=12.3/12.3/12.3\nRome=20.0/20.0/20.0\n"},
+		{[]string{"-exclude", "Paris,Rome"}, "Lima=18.0/18.0/18.0\nOslo=-4.0/-4.0/-4.0\n"},
+		{[]string{"-include", "@" + list}, "Oslo=-4.0/-4.0/-4.0\nRome=20.0/20.0/20.0\n"},
+		{[]string{"-include", "Paris,Rome", "-exclude", "Rome"}, "Paris=12.3/12.3/12.3\n"},
+	} {
+		if got := solveArgs(t, input, tc.args...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestRegexFilter(t *testing.T) {
+	input := "Paris;12.3\nOslo;-4.0\nPalermo;20.0\n"
+	if got, want := solveArgs(t, input, "-regex-filter", "^Pa", "-exclude", "Palermo"), "Paris=12.3/12.3/12.3\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	_, stderr, code := run1brc(t, "", "-quiet", "-regex-filter", "(", writeInput(t, input))
+	if code != exitIOError || !strings.Contains(stderr, "missing closing )") {
+		t.Errorf("exit code %d, stderr %q", code, stderr)
+	}
+}
+
+func TestAddReaderConcurrently(t *testing.T) {
+	agg := newAggregator(defaultArgs())
+	defer agg.Close()
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			input := strings.Repeat(fmt.Sprintf("Paris;%d.0\nOslo;-4.0\n", i), 1000)
+			if err := agg.AddReader(strings.NewReader(input)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if got, want := summary(t, agg), "Oslo=-4.0/-4.0/-4.0 (8000)\nParis=0.0/3.5/7.0 (8000)\n"; got != want {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+	if rows := agg.Rows(); rows != 16000 {
+		t.Errorf("got %d rows, want 16000", rows)
+	}
+}
+
+func TestAddReaderTwice(t *testing.T) {
+	names := genNames(300, 3, 20)
+	first, second := genMeasurements(1_000_000, names), genMeasurements(700_000, names[100:])
+	for name, tc := range map[string]struct{ first, second []byte }{
+		"terminated": {first, second},
+		// the last line of a reader ends with it, it is never joined with
+		// the start of the next reader
+		"unterminated": {append(bytes.Clone(first), "Paris;12.3"...), append([]byte("Oslo;-4.0\n"), second...)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			serial := newAggregator(defaultArgs())
+			defer serial.Close()
+			for _, input := range [][]byte{tc.first, tc.second} {
+				if err := serial.AddReader(bytes.NewReader(input)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var sep []byte
+			if !bytes.HasSuffix(tc.first, []byte("\n")) {
+				sep = []byte("\n")
+			}
+			concatenated := slices.Concat(tc.first, sep, tc.second)
+			want := extremes(t, aggregate(t, defaultArgs(), bytes.NewReader(concatenated)))
+			if got := extremes(t, serial); got != want {
+				t.Error("two serial reads differ from a single read of the concatenated input")
+			}
+			if rows, want := serial.Rows(), int64(bytes.Count(concatenated, []byte("\n"))); rows != want {
+				t.Errorf("got %d rows, want %d", rows, want)
+			}
+		})
+	}
+}
+
+func TestLogging(t *testing.T) {
+	input := writeInput(t, "Paris;12.3\n")
+	_, stderr, code := run1brc(t, "", "-quiet", "-log-format", "json", input)
+	if code != exitOK {
+		t.Fatalf("exit code %d, stderr %q", code, stderr)
+	}
+	var record struct {
+		Level string   `json:"level"`
+		Msg   string   `json:"msg"`
+		Files []string `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(strings.SplitN(stderr, "\n", 2)[0]), &record); err != nil {
+		t.Fatalf("%v in %q", err, stderr)
+	}
+	if record.Level != "INFO" || record.Msg != "starting to read files" || len(record.Files) != 1 || record.Files[0] != input {
+		t.Errorf("got %+v", record)
+	}
+	if _, stderr, _ := run1brc(t, "", "-quiet", "-log-level", "warn", input); stderr != "" {
+		t.Errorf("got %q at -log-level warn", stderr)
+	}
+	if _, _, code := run1brc(t, "", "-log-format", "xml", input); code != exitIOError {
+		t.Errorf("-log-format xml: exit code %d", code)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	input := "Paris;12.3\nOslo;-40.0\nParis;14.1\n"
+	if got, want := solveArgs(t, input, "-units", "f"), "Oslo=-40.0/-40.0/-40.0\nParis=54.1/55.8/57.4\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// rounded to tenths after the conversion, on either side of 0 °F
+	for c, f := range map[string]string{
+		"0.0":   "32.0",
+		"-17.7": "0.1",  // 0.14
+		"-17.8": "0.0",  // -0.04, without a sign
+		"-20.1": "-4.2", // -4.18
+		"-12.3": "9.9",  // 9.86
+		"21.1":  "70.0", // 69.98
+	} {
+		if got, want := solveArgs(t, "A;"+c+"\n", "-units", "f"), "A="+f+"/"+f+"/"+f+"\n"; got != want {
+			t.Errorf("%s °C: got %q, want %q", c, got, want)
+		}
+	}
+	// the thresholds are in the units printed
+	if got, want := solveArgs(t, input, "-units", "f", "-mean-above", "50"), "Paris=54.1/55.8/57.4\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, _, code := run1brc(t, "", "-units", "k", writeInput(t, input)); code != exitIOError {
+		t.Errorf("-units k: exit code %d", code)
+	}
+}
+
+func TestSubworkers(t *testing.T) {
+	input := genMeasurements(1_000_000, genNames(300, 3, 20))
+	opts := defaultArgs()
+	opts.workers, opts.subworkers = 2, 1
+	want := extremes(t, aggregate(t, opts, bytes.NewReader(input)))
+	for _, subworkers := range []int{3, 8} {
+		opts.subworkers = subworkers
+		if got := extremes(t, aggregate(t, opts, bytes.NewReader(input))); got != want {
+			t.Errorf("-subworkers %d disagrees with -subworkers 1", subworkers)
+		}
+	}
+}
+
+func TestMeanThresholds(t *testing.T) {
+	input := "Paris;12.3\nOslo;-4.0\nRome;20.0\n"
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-mean-above", "12.3"}, "Rome=20.0/20.0/20.0\n"},
+		{[]string{"-mean-below", "12.3"}, "Oslo=-4.0/-4.0/-4.0\n"},
+		{[]string{"-mean-above", "0", "-mean-below", "15"}, "Paris=12.3/12.3/12.3\n"},
+	} {
+		if got := solveArgs(t, input, tc.args...); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		args  []string
+		panic bool
+		want  int
+	}{
+		{"ok", "Paris;12.3\n", nil, false, exitOK},
+		{"missing file", "", []string{filepath.Join(t.TempDir(), "missing.txt")}, false, exitIOError},
+		{"bad flag", "Paris;12.3\n", []string{"-sample", "2"}, false, exitIOError},
+		{"parse error", "Paris;12.3\nOslo;x\n", []string{"-strict"}, false, exitParseErr},
+		// not validated without -strict, but still no value to fold
+		{"malformed value", "Paris;3\n", nil, false, exitParseErr},
+		{"malformed value -ascii-fast", "Paris;3\n", []string{"-ascii-fast"}, false, exitParseErr},
+		{"panic", "Paris;12.3\n", nil, true, exitPanic},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.panic {
+				t.Setenv("BRC_TEST_PANIC", "1")
+			}
+			args := append([]string{"-quiet"}, tc.args...)
+			if tc.input != "" {
+				args = append(args, writeInput(t, tc.input))
+			}
+			_, stderr, code := run1brc(t, "", args...)
+			if code != tc.want || tc.panic && !strings.Contains(stderr, "internal error: injected by BRC_TEST_PANIC") {
+				t.Errorf("exit code %d, want %d, stderr %q", code, tc.want, stderr)
+			}
+		})
+	}
+}
+
+func TestRows(t *testing.T) {
+	input := genMeasurements(1_500_000, genNames(100, 3, 20))
+	opts := defaultArgs()
+	opts.workers, opts.subworkers = 4, 2
+	agg := aggregate(t, opts, bytes.NewReader(input))
+	if rows := agg.Rows(); rows != 1_500_000 {
+		t.Errorf("got %d rows, want 1500000", rows)
+	}
+}
+
+func TestBufferPoolReuse(t *testing.T) {
+	long := strings.Repeat("Paris;12.3\n", 1000)
+	if got := summary(t, aggregate(t, defaultArgs(), strings.NewReader(long))); got != "Paris=12.3/12.3/12.3 (1000)\n" {
+		t.Fatalf("got %q", got)
+	}
+	// the buffers of the longer input are not cleared, none of it must show
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for range 10 {
+		if got := summary(t, aggregate(t, defaultArgs(), strings.NewReader("Oslo;-4.0\n"))); got != "Oslo=-4.0/-4.0/-4.0 (1)\n" {
+			t.Fatalf("got %q", got)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	// the race detector drops pooled buffers on purpose
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > readBufferSize && !raceEnabled {
+		t.Errorf("10 solves allocated %d bytes, more than a single buffer", allocated)
+	}
+}
+
+// Run the executable on a pipe that is written once and then held open, so
+// that only a -timeout ends the run.
+func run1brcStalled(t *testing.T, written string, args ...string) (string, string, int) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	cmd := exec.Command(os.Args[0], append(args, "/dev/stdin")...)
+	cmd.Env = append(os.Environ(), "BRC_TEST_MAIN=1")
+	cmd.Stdin = r
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := io.WriteString(w, written); err != nil {
+		t.Fatal(err)
+	}
+	var exit *exec.ExitError
+	if err := cmd.Wait(); err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+func TestTimeout(t *testing.T) {
+	stdout, stderr, code := run1brcStalled(t, "Paris;12.3\n", "-quiet", "-timeout", "100ms")
+	if code != exitIOError || stdout != "" || !strings.Contains(stderr, context.DeadlineExceeded.Error()) {
+		t.Errorf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	stdout, stderr, code = run1brcStalled(t, "Paris;12.3\n", "-quiet", "-timeout", "100ms", "-best-effort")
+	if code != exitIOError || stdout != "# partial results: context deadline exceeded\nParis=12.3/12.3/12.3\n" {
+		t.Errorf("-best-effort: exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	for err, want := range map[error]string{
+		&fs.PathError{Op: "open", Path: "m.txt", Err: fs.ErrNotExist}:   "no such file, check the path",
+		&fs.PathError{Op: "open", Path: "m.txt", Err: fs.ErrPermission}: "permission denied, check the file permissions",
+		&fs.PathError{Op: "stat", Path: "m.txt", Err: errIsDirectory}:   "expected a file but got a directory",
+	} {
+		logs.Reset()
+		if code := gracefullyHanldeErrors(err); code != exitIOError {
+			t.Errorf("%v: exit code %d", err, code)
+		}
+		if !strings.Contains(logs.String(), want) || !strings.Contains(logs.String(), "path=m.txt") {
+			t.Errorf("%v: logged %q, want %q", err, logs.String(), want)
+		}
+	}
+
+	for name, path := range map[string]string{"missing": filepath.Join(t.TempDir(), "m.txt"), "directory": t.TempDir()} {
+		stdout, stderr, code := run1brc(t, "", "-quiet", path)
+		if code != exitIOError || stdout != "" || strings.Contains(stderr, "goroutine") {
+			t.Errorf("%s: exit code %d, stdout %q, stderr %q", name, code, stdout, stderr)
+		}
+	}
+}
+
+func TestRangeCheck(t *testing.T) {
+	input := "Paris;12.3\nOslo;100.0\nRome;-99.9\n"
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	opts := defaultArgs()
+	opts.rangeCheck = true
+	if got, want := summary(t, aggregate(t, opts, strings.NewReader(input))), "Oslo=100.0/100.0/100.0 (1)\nParis=12.3/12.3/12.3 (1)\nRome=-99.9/-99.9/-99.9 (1)\n"; got != want {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+	if want := `msg="value out of [-99.9, 99.9]" station=Oslo value=100 line=2`; !strings.Contains(logs.String(), want) || strings.Count(logs.String(), "out of") != 1 {
+		t.Errorf("logged %q, want only %q", logs.String(), want)
+	}
+
+	opts.strict = true
+	err := newAggregator(opts).AddReader(strings.NewReader(input))
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 2 || pe.Reason != "value out of [-99.9, 99.9]" {
+		t.Errorf("got %v with -strict, want the value of line 2 out of range", err)
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	input := string(genMeasurements(100_000, genNames(1234, 3, 20)))
+	if got := solveArgs(t, input, "-distinct"); got != "1234\n" {
+		t.Errorf("got %q, want 1234", got)
+	}
+}
+
+func TestMergePerFile(t *testing.T) {
+	a := defaultArgs()
+	for i := range 3 {
+		input := genMeasurements(300_000+50_000*i, genNames(200, 3, 20)) // the same stations
+		a.filenames = append(a.filenames, writeInput(t, string(input)))
+	}
+	a.filename = a.filenames[0]
+	solve := func() string {
+		agg, err := solve1brc(context.Background(), a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer agg.Close()
+		return extremes(t, agg)
+	}
+	want := solve()
+	a.mergePerFile = true
+	if got := solve(); got != want {
+		t.Error("the results with -merge-per-file differ from the ones without")
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	input := "Paris;12.3\r\nOslo;-4.0\nParis;14.1\r\nRome;2.0"
+	opts := defaultArgs()
+	opts.normalizeNewlines = true
+	want := "Oslo=-4.0/-4.0/-4.0 (1)\nParis=12.3/13.2/14.1 (2)\nRome=2.0/2.0/2.0 (1)\n"
+	for _, strict := range []bool{false, true} {
+		opts.strict = strict
+		if got := summary(t, aggregate(t, opts, &chunkReader{input[:11], input[11:]})); got != want {
+			t.Errorf("-strict=%v: got\n%swant\n%s", strict, got, want)
+		}
+	}
+	opts.normalizeNewlines = false
+	err := newAggregator(opts).AddReader(strings.NewReader(input))
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 1 {
+		t.Errorf("got %v for a \\r without -normalize-newlines", err)
+	}
+}
+
+// A writer counting the writes it gets.
+type writeCounter struct {
+	strings.Builder
+	writes int
+}
+
+func (w *writeCounter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Builder.Write(b)
+}
+
+func TestStream(t *testing.T) {
+	agg := aggregate(t, defaultArgs(), strings.NewReader("Paris;12.3\nOslo;-4.0\nRome;2.0\n"))
+	for _, stream := range []bool{false, true} {
+		a := defaultArgs()
+		a.stream = stream
+		var out writeCounter
+		w := bufio.NewWriterSize(&out, a.outputBufferSize)
+		if err := printSolutions(w, agg, a); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		want := 1
+		if stream {
+			want = 3 // a flush per station
+		}
+		if out.writes != want || out.String() != "Oslo=-4.0/-4.0/-4.0\nParis=12.3/12.3/12.3\nRome=2.0/2.0/2.0\n" {
+			t.Errorf("-stream=%v: got %q in %d writes, want %d", stream, out.String(), out.writes, want)
+		}
+	}
+}
+
+func TestResolveWorkers(t *testing.T) {
+	cpus := runtime.NumCPU()
+	for _, tc := range []struct {
+		workers int
+		size    int64
+		want    int
+	}{
+		{3, 1 << 40, 3},
+		{0, 0, 1},
+		{0, 100, 1},
+		{0, autoWorkerBytes, 1},
+		{0, autoWorkerBytes + 1, min(2, cpus)},
+		{0, 1 << 40, cpus},
+		{0, -1, cpus},
+	} {
+		if got := resolveWorkers(tc.workers, tc.size); got != tc.want {
+			t.Errorf("resolveWorkers(%d, %d) = %d, want %d", tc.workers, tc.size, got, tc.want)
+		}
+	}
+	path := writeInput(t, "Paris;12.3\n")
+	stdout, stderr, code := run1brc(t, "", "-quiet", "-workers", "auto", "-dry-run", path)
+	if code != exitOK || !strings.Contains(stderr, "workers:     1\n") {
+		t.Errorf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	if got := solveArgs(t, "Paris;12.3\n", "-workers", "auto"); got != "Paris=12.3/12.3/12.3\n" {
+		t.Errorf("got %q with -workers auto", got)
+	}
+}
+
+func TestAnomaly(t *testing.T) {
+	input := "Paris;12.3\nOslo;-4.0\nParis;14.1\n"
+	agg := aggregate(t, defaultArgs(), strings.NewReader(input))
+	if got, want := agg.GlobalMean(), (12.3-4.0+14.1)/3; !closeTo(got, want, 1e-9) {
+		t.Errorf("got a global mean of %v, want %v", got, want)
+	}
+	if got, want := solveArgs(t, input, "-anomaly"), "Oslo=-4.0/-4.0/-4.0 anomaly=-11.5\nParis=12.3/13.2/14.1 anomaly=5.7\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPipeInput(t *testing.T) {
+	input := "Paris;12.3\nOslo;-4.0\n"
+	r, w := io.Pipe()
+	go func() {
+		for _, line := range strings.SplitAfter(input, "\n") {
+			io.WriteString(w, line)
+		}
+		w.Close()
+	}()
+	if got, want := summary(t, aggregate(t, defaultArgs(), r)), "Oslo=-4.0/-4.0/-4.0 (1)\nParis=12.3/12.3/12.3 (1)\n"; got != want {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+
+	// stdin of the executable is a pipe, a stream of unknown size
+	stdout, stderr, code := run1brc(t, input, "-quiet", "-log-level", "error", "-workers", "auto", "/dev/stdin")
+	if code != exitOK || stdout != "Oslo=-4.0/-4.0/-4.0\nParis=12.3/12.3/12.3\n" {
+		t.Errorf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	_, stderr, code = run1brc(t, input, "-quiet", "-dry-run", "/dev/stdin")
+	if code != exitOK || !strings.Contains(stderr, "file size:   unknown") || !strings.Contains(stderr, "chunks:      unknown") {
+		t.Errorf("exit code %d, stderr %q", code, stderr)
+	}
+}
+
+func TestMinCount(t *testing.T) {
+	input := "Paris;12.3\nOslo;-4.0\nParis;14.1\nRome;2.0\n"
+	stdout, stderr, code := run1brc(t, "", "-quiet", "-min-count", "2", writeInput(t, input))
+	if code != exitOK || stdout != "Paris=12.3/13.2/14.1\n" {
+		t.Fatalf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	if want := `msg="dropped stations below -min-count" stations=2 min_count=2`; !strings.Contains(stderr, want) {
+		t.Errorf("got %q, want it to hold %q", stderr, want)
+	}
+}
+
+func TestStationStatsString(t *testing.T) {
+	input := "Paris;12.3\nParis;14.1\nZero;-0.1\nZero;0.0\nZero;0.0\nHalf;0.1\nHalf;0.2\nNeg;-99.9\n"
+	stats, err := aggregate(t, defaultArgs(), strings.NewReader(input)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got strings.Builder
+	for _, s := range stats {
+		got.WriteString(s.String() + "\n")
+	}
+	if printed := solveArgs(t, input); got.String() != printed {
+		t.Errorf("got\n%sprinted\n%s", got.String(), printed)
+	}
+	if want := "Half=0.1/0.2/0.2\nNeg=-99.9/-99.9/-99.9\nParis=12.3/13.2/14.1\nZero=-0.1/0.0/0.0\n"; got.String() != want {
+		t.Errorf("got\n%swant\n%s", got.String(), want)
+	}
+}
+
+func TestShuffleCheck(t *testing.T) {
+	a := defaultArgs()
+	a.filename = writeInput(t, string(genMeasurements(200_000, genNames(500, 3, 20))))
+	a.filenames = []string{a.filename}
+	a.workers = 4
+	if err := shuffleCheck(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	a.sample = 0.5
+	if err := shuffleCheck(context.Background(), a); err == nil {
+		t.Error("-shuffle-check ran with -sample")
+	}
+}
+
+func TestCountHist(t *testing.T) {
+	// a station of 1 reading, two of 10 to 99 and one of 100 to 999
+	var b strings.Builder
+	b.WriteString("One;1.0\n")
+	for i := range 150 {
+		b.WriteString("Hundreds;1.0\n")
+		if i < 10 {
+			b.WriteString("Tens;1.0\n")
+		}
+		if i < 99 {
+			b.WriteString("Tens2;1.0\n")
+		}
+	}
+	path := filepath.Join(t.TempDir(), "hist.txt")
+	solveArgs(t, b.String(), "-count-hist", path)
+	hist, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1-9 1\n10-99 2\n100-999 1\n"; string(hist) != want {
+		t.Errorf("got %q, want %q", hist, want)
+	}
+	total := 0
+	for line := range strings.Lines(string(hist)) {
+		var lo, hi, n int
+		if _, err := fmt.Sscanf(line, "%d-%d %d", &lo, &hi, &n); err != nil {
+			t.Fatal(err)
+		}
+		total += n
+	}
+	if total != 4 {
+		t.Errorf("the buckets sum to %d stations, want 4", total)
+	}
+}
+
+func TestMeanRoundedOnce(t *testing.T) {
+	// means of exactly x.x5, which %.1f would round to even after the
+	// rounding away from zero
+	if got := fmt.Sprintf("%.1f", 2.25); got != "2.2" {
+		t.Fatalf("%%.1f rounds 2.25 to %s, the test no longer tells", got)
+	}
+	for input, want := range map[string]string{
+		"A;2.2\nA;2.3\n":   "A=2.2/2.3/2.3\n",
+		"A;-2.2\nA;-2.3\n": "A=-2.3/-2.3/-2.2\n",
+		"A;0.1\nA;0.0\n":   "A=0.0/0.1/0.1\n",
+	} {
+		if got := solveArgs(t, input); got != want {
+			t.Errorf("%q: got %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestOutputBufferSize(t *testing.T) {
+	input := writeInput(t, "Paris;12.3\n")
+	_, stderr, code := run1brc(t, "", "-quiet", "-output-buffer-size", "100", input)
+	if code != exitIOError || !strings.Contains(stderr, fmt.Sprint("at least ", minOutputBufferSize)) {
+		t.Errorf("exit code %d, stderr %q", code, stderr)
+	}
+	if got := solveArgs(t, "Paris;12.3\n", "-output-buffer-size", fmt.Sprint(minOutputBufferSize)); got != "Paris=12.3/12.3/12.3\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestMergeWhitespace(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	opts := defaultArgs()
+	opts.mergeWhitespace = true
+	agg := aggregate(t, opts, strings.NewReader("Paris;10.0\nParis ;20.0\nOslo ;1.0\nParis;30.0\n"))
+	var b strings.Builder
+	if err := printSolutions(&b, agg, opts); err != nil {
+		t.Fatal(err)
+	}
+	// a lone "Oslo " has nothing to merge with
+	if want := "Oslo =1.0/1.0/1.0\nParis=10.0/20.0/30.0\n"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+	if !strings.Contains(logs.String(), `msg="merged stations differing by whitespace" station=Paris`) || strings.Contains(logs.String(), "station=Oslo") {
+		t.Errorf("logged %q", logs.String())
+	}
+}
+
+func TestStationsFile(t *testing.T) {
+	input := "Paris;12.3\nOslo;-1.0\nLima;20.0\n"
+	stations := filepath.Join(t.TempDir(), "stations.txt")
+	if err := os.WriteFile(stations, []byte("Paris\nOslo\nNowhere\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := solveArgs(t, input)
+	// Nowhere is prewarmed but never seen, and Lima is not prewarmed
+	if got := solveArgs(t, input, "-stations-file", stations); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := solveArgs(t, input, "-stations-file", stations, "-format", "table"); strings.Contains(got, "Nowhere") {
+		t.Errorf("printed the unseen station: %q", got)
+	}
+
+	opts := defaultArgs()
+	opts.stations = []string{"Nowhere", "Oslo", "Paris"}
+	agg := aggregate(t, opts, strings.NewReader(input))
+	if n := agg.Len(); n != 3 {
+		t.Errorf("got %d stations, want 3", n)
+	}
+	if _, ok := agg.Get("Nowhere"); ok {
+		t.Error("got the unseen station")
+	}
+}
+
+func TestGroupByPrefix(t *testing.T) {
+	input := "US:Dallas;30.0\nUS:Austin;10.0\nUS:Austin;20.0\nFR:Paris;-5.0\nFR:Lyon;15.0\nNowhere;1.0\n"
+	// the means weighted by the readings, (30+10+20)/3 rather than (30+15)/2
+	want := "FR=-5.0/5.0/15.0\nNowhere=1.0/1.0/1.0\nUS=10.0/20.0/30.0\n"
+	if got := solveArgs(t, input, "-group-by-prefix", ":"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWorkersOverCPUs(t *testing.T) {
+	input := writeInput(t, "Paris;12.3\n")
+	workers := fmt.Sprint(runtime.NumCPU() + 1)
+	for _, quiet := range []bool{false, true} {
+		args := []string{"-workers", workers, input}
+		if quiet {
+			args = append([]string{"-quiet"}, args...)
+		}
+		_, stderr, code := run1brc(t, "", args...)
+		if code != exitOK {
+			t.Fatalf("exit code %d, stderr %q", code, stderr)
+		}
+		if warned := strings.Contains(stderr, "more workers than CPUs"); warned == quiet {
+			t.Errorf("-quiet %v: stderr %q", quiet, stderr)
+		}
+	}
+	if _, stderr, _ := run1brc(t, "", "-workers", fmt.Sprint(runtime.NumCPU()), input); strings.Contains(stderr, "more workers than CPUs") {
+		t.Errorf("warned at as many workers as CPUs: %q", stderr)
+	}
+}
+
+func TestASCIIFast(t *testing.T) {
+	input := append(genMeasurements(200_000, genNames(1000, 1, 30)), "a;1.0\nab;-99.9\nabc;0.0\nx;-1.5\n"...)
+	opts := defaultArgs()
+	opts.workers = 1 // the means of one summation order
+	want := summary(t, aggregate(t, opts, bytes.NewReader(input)))
+	opts.asciiFast = true
+	if got := summary(t, aggregate(t, opts, bytes.NewReader(input))); got != want {
+		t.Error("the results with -ascii-fast differ from the ones without")
+	}
+}
+
+func TestNoMergeAlloc(t *testing.T) {
+	input := genMeasurements(2_000_000, genNames(500, 3, 20))
+	opts := defaultArgs()
+	opts.workers = 4
+	want := extremes(t, aggregate(t, opts, bytes.NewReader(input)))
+	opts.noMergeAlloc = true
+	for _, readers := range []int{1, 2} {
+		agg := newAggregator(opts)
+		t.Cleanup(func() { agg.Close() })
+		for range readers {
+			if err := agg.AddReader(bytes.NewReader(input)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the adopted map counted once, the rows of the second reader
+		// merged into it
+		if got := extremes(t, agg); readers == 1 && got != want {
+			t.Errorf("got\n%swant\n%s", got, want)
+		}
+		if rows := agg.Rows(); rows != int64(readers)*2_000_000 {
+			t.Errorf("%d readers: got %d rows", readers, rows)
+		}
+		var total int
+		agg.ForEachSorted(func(s StationStats) { total += s.Count })
+		if total != readers*2_000_000 {
+			t.Errorf("%d readers: the stations count %d readings", readers, total)
+		}
+	}
+}
+
+func TestEmitEmpty(t *testing.T) {
+	stations := filepath.Join(t.TempDir(), "stations.txt")
+	if err := os.WriteFile(stations, []byte("Paris\nNowhere\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := solveArgs(t, "Paris;12.3\nOslo;-1.0\n", "-stations-file", stations, "-emit-empty"), "Nowhere=NA/NA/NA\nOslo=-1.0/-1.0/-1.0\nParis=12.3/12.3/12.3\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	_, stderr, code := run1brc(t, "", "-quiet", "-emit-empty", writeInput(t, "Paris;12.3\n"))
+	if code != exitIOError || !strings.Contains(stderr, "-emit-empty needs") {
+		t.Errorf("without -stations-file: exit code %d, stderr %q", code, stderr)
+	}
+}
+
+func TestQuoted(t *testing.T) {
+	opts := defaultArgs()
+	opts.quoted = true
+	for _, strict := range []bool{false, true} {
+		opts.strict = strict
+		agg := aggregate(t, opts, strings.NewReader("\"A;B\";1.0\n\"say \"\"hi\"\"\";2.0\nPlain;3.0\n\"A;B\";-1.0\n"))
+		if got, want := summary(t, agg), "A;B=-1.0/0.0/1.0 (2)\nPlain=3.0/3.0/3.0 (1)\nsay \"hi\"=2.0/2.0/2.0 (1)\n"; got != want {
+			t.Errorf("-strict %v: got %q, want %q", strict, got, want)
+		}
+	}
+
+	opts.strict = false // an unterminated quote fails either way
+	agg := newAggregator(opts)
+	defer agg.Close()
+	var perr *ParseError
+	if err := agg.AddReader(strings.NewReader("Plain;3.0\n\"Open;1.0\n")); !errors.As(err, &perr) || perr.Line != 2 {
+		t.Errorf("got %v, want a parse error on line 2", err)
+	}
+}
+
+func TestProfileDuration(t *testing.T) {
+	t.Chdir(t.TempDir()) // where the profile is written
+	_, stderr, code := run1brcStalled(t, "Paris;12.3\n", "-p", "-profile-duration", "50ms", "-timeout", "500ms")
+	// stopped by the timer well before the timeout, then once more on exit
+	stopped := strings.Index(stderr, "stopped the cpu profile")
+	timedOut := strings.Index(stderr, context.DeadlineExceeded.Error())
+	if code != exitIOError || stopped < 0 || timedOut < stopped {
+		t.Errorf("exit code %d, stderr %q", code, stderr)
+	}
+	profiles, err := filepath.Glob("cpu-*.prof")
+	if err != nil || len(profiles) != 1 {
+		t.Fatalf("got the profiles %q, %v", profiles, err)
+	}
+	if info, err := os.Stat(profiles[0]); err != nil || info.Size() == 0 {
+		t.Errorf("got an empty profile, %v", err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	t.Chdir(t.TempDir()) // where the trace is written
+	input := writeInput(t, "Paris;12.3\n")
+	if _, stderr, code := run1brc(t, "", "-quiet", "-trace", input); code != exitOK {
+		t.Fatalf("exit code %d, stderr %q", code, stderr)
+	}
+	traces, err := filepath.Glob("trace-*.out")
+	if err != nil || len(traces) != 1 {
+		t.Fatalf("got the traces %q, %v", traces, err)
+	}
+	if info, err := os.Stat(traces[0]); err != nil || info.Size() == 0 {
+		t.Errorf("got an empty trace, %v", err)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	for v, want := range map[string]int64{"512": 512, "64k": 64 << 10, "512M": 512 << 20, "2G": 2 << 30} {
+		if got, err := parseSize(v); err != nil || got != want {
+			t.Errorf("%s: got %d, %v, want %d", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"", "G", "0", "-1G", "2X", "1.5G", "9000000T"} {
+		if _, err := parseSize(v); err == nil {
+			t.Errorf("%q parsed", v)
+		}
+	}
+
+	prev := debug.SetMemoryLimit(-1) // only reads it
+	restore := setMemoryLimit(512 << 20)
+	if got := debug.SetMemoryLimit(-1); got != 512<<20 {
+		t.Errorf("got the limit %d, want %d", got, 512<<20)
+	}
+	restore()
+	if got := debug.SetMemoryLimit(-1); got != prev {
+		t.Errorf("restored the limit %d, want %d", got, prev)
+	}
+
+	// rejected by the flag package, exiting with the usage
+	_, stderr, code := run1brc(t, "", "-quiet", "-max-memory", "2X", writeInput(t, "Paris;12.3\n"))
+	if code == exitOK || !strings.Contains(stderr, "must be a positive size") {
+		t.Errorf("exit code %d, stderr %q", code, stderr)
+	}
+}
+
+func TestFileParallelism(t *testing.T) {
+	names := genNames(200, 3, 20)
+	args := []string{"-quiet", "-aggs", "min,max,count"} // the means may round either way
+	for i := range 4 {
+		args = append(args, writeInput(t, string(genMeasurements(300_000+i*1000, names[i*20:i*20+100]))))
+	}
+	solve := func(args ...string) string {
+		stdout, stderr, code := run1brc(t, "", args...)
+		if code != exitOK {
+			t.Fatalf("exit code %d, stderr %q", code, stderr)
+		}
+		return stdout
+	}
+	want := solve(args...)
+	if got := solve(append([]string{"-file-parallelism", "2", "-workers", "4"}, args...)...); got != want {
+		t.Errorf("-file-parallelism 2 got\n%swant\n%s", got, want)
+	}
+}
+
+func TestBytesPerStation(t *testing.T) {
+	input := append(genMeasurements(1_000_000, genNames(300, 3, 40)), "Paris;12.3"...) // unterminated
+	opts := defaultArgs()
+	opts.workers, opts.subworkers = 4, 2
+	opts.bytesPerStation = true
+	var total int64
+	aggregate(t, opts, bytes.NewReader(input)).ForEachSorted(func(s StationStats) { total += s.Bytes })
+	if want := int64(len(input) - bytes.Count(input, []byte("\n"))); total != want {
+		t.Errorf("the stations add up to %d bytes, want %d", total, want)
+	}
+}
+
+func TestTableFormat(t *testing.T) {
+	got := solveArgs(t, "A;1.0\nLongStationName;-12.3\nMid;99.9\nMid;-99.9\n", "-format", "table")
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "A ") || !strings.HasPrefix(lines[3], "Mid ") {
+		t.Fatalf("got %q", got)
+	}
+	// the names left aligned from column 0, the numbers right aligned to
+	// the ends of the header columns
+	var ends []int
+	for i := 1; i < len(lines[0]); i++ {
+		if lines[0][i] == ' ' && lines[0][i-1] != ' ' {
+			ends = append(ends, i)
+		}
+	}
+	ends = append(ends, len(lines[0]))[1:]
+	for _, line := range lines[1:] {
+		if len(line) != len(lines[0]) {
+			t.Errorf("%q is not as long as the header %q", line, lines[0])
+			continue
+		}
+		for _, end := range ends {
+			if line[end-1] == ' ' || line[end-2] == ' ' || end < len(line) && line[end] != ' ' {
+				t.Errorf("%q does not end a column at %d", line, end)
+			}
+		}
+	}
+}
+
+func TestSigterm(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	cmd := exec.Command(os.Args[0], "/dev/stdin")
+	cmd.Env = append(os.Environ(), "BRC_TEST_MAIN=1")
+	cmd.Stdin = r
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := io.WriteString(w, "Paris;12.3\nOslo;-1.0\n"); err != nil {
+		t.Fatal(err)
+	}
+	// the handler is in place once the files are being read, and the read
+	// of the written rows follows right after
+	logs := bufio.NewScanner(stderr)
+	for logs.Scan() && !strings.Contains(logs.Text(), "starting to read files") {
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	var rest strings.Builder
+	for logs.Scan() {
+		rest.WriteString(logs.Text() + "\n")
+	}
+	var exit *exec.ExitError
+	if err := cmd.Wait(); err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	want := "# partial results: " + errTerminated.Error() + "\nOslo=-1.0/-1.0/-1.0\nParis=12.3/12.3/12.3\n"
+	if code := cmd.ProcessState.ExitCode(); code != exitIOError || stdout.String() != want {
+		t.Errorf("exit code %d, stdout %q, stderr %q", code, stdout.String(), rest.String())
+	}
+}
+
+func TestPlusSign(t *testing.T) {
+	for in, want := range map[string]float64{"+12.3": 12.3, "12.3": 12.3, "-12.3": -12.3, "+0.0": 0, "+99.9": 99.9} {
+		if got, ok := fastParseFloat64([]byte(in)); !ok || got != want {
+			t.Errorf("%s: got %v, want %v", in, got, want)
+		}
+	}
+	for _, strict := range []bool{false, true} {
+		opts := defaultArgs()
+		opts.strict = strict
+		if got := summary(t, aggregate(t, opts, strings.NewReader("Paris;+12.3\nParis;-2.3\n"))); got != "Paris=-2.3/5.0/12.3 (2)\n" {
+			t.Errorf("-strict %v: got %q", strict, got)
+		}
+	}
+}
+
+func TestMalformedValues(t *testing.T) {
+	for _, tc := range []struct {
+		line, reason string
+		args         []string
+	}{
+		{"A;5", "value is not a number with one fractional digit", nil},
+		{"A;5.", "value is not a number with one fractional digit", nil},
+		{"A;.5", "value is not a number with one fractional digit", nil},
+		{"A;-", "value is not a number with one fractional digit", nil},
+		{"A;x", "value is not a number with one fractional digit", nil},
+		{"A;12.34", "value is not a number with one fractional digit", nil},
+		{"A;100.0", "value out of [-99.9, 99.9]", nil},
+		{"A;5", "value is not a number with one fractional digit", []string{"-ascii-fast"}},
+		{"Paris12.3", "missing ';' or value", []string{"-ascii-fast"}},
+	} {
+		args := append([]string{"-quiet"}, tc.args...)
+		_, stderr, code := run1brc(t, "", append(args, writeInput(t, "Paris;12.3\n"+tc.line+"\nLima;1.0\n"))...)
+		if code != exitParseErr || !strings.Contains(stderr, "line 2 ") || !strings.Contains(stderr, tc.reason) {
+			t.Errorf("%q %v: exit code %d, stderr %q", tc.line, tc.args, code, stderr)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	input := genMeasurements(500_000, genNames(1000, 3, 20))
+	for _, spill := range []int{0, 100} {
+		opts := defaultArgs()
+		opts.workers, opts.spill = 4, spill
+		agg := aggregate(t, opts, bytes.NewReader(input))
+		want, err := agg.Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []StationStats{want[0], want[len(want)/2], want[len(want)-1]} {
+			if got, ok := agg.Get(s.Name); !ok || got.String() != s.String() || got.Count != s.Count {
+				t.Errorf("-spill %d: got %+v, %v, want %+v", spill, got, ok, s)
+			}
+		}
+		if got, ok := agg.Get("Nowhere"); ok {
+			t.Errorf("-spill %d: got the absent station %+v", spill, got)
+		}
+		if err := agg.Err(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestStrictSpec(t *testing.T) {
+	for _, tc := range []struct {
+		line, reason string
+	}{
+		{"Oslo;12.34\n", "value is not a number with one fractional digit"},
+		{"Oslo;12\n", "value is not a number with one fractional digit"},
+		{"Oslo;100.0\n", "value out of [-99.9, 99.9]"},
+		{"Oslo;1;1.0\n", "not exactly one ';'"},
+		{";1.0\n", "empty station name"},
+		{"Oslo ;1.0\n", "station name has surrounding whitespace"},
+		{"Oslo;+1.0\n", "explicit '+' sign"},
+		{"Oslo;1.0", "is not terminated"},
+	} {
+		input := "Paris;12.3\n" + tc.line
+		if strings.HasSuffix(tc.line, "\n") {
+			input += "Lima;1.0\n" // the first violation is reported
+		}
+		_, stderr, code := run1brc(t, "", "-quiet", "-strict-spec", writeInput(t, input))
+		if code != exitParseErr || !strings.Contains(stderr, "line 2 ") || !strings.Contains(stderr, tc.reason) {
+			t.Errorf("%q: exit code %d, stderr %q", tc.line, code, stderr)
+		}
+	}
+	if got := solveArgs(t, "Paris;12.3\nOslo;-99.9\n", "-strict-spec"); got != "Oslo=-99.9/-99.9/-99.9\nParis=12.3/12.3/12.3\n" {
+		t.Errorf("a conforming input got %q", got)
+	}
+}
+
+func TestSolveLineErrors(t *testing.T) {
+	for _, line := range []string{"Oslo", "Oslo;"} {
+		agg := newAggregator(defaultArgs()) // not -strict
+		var perr *ParseError
+		err := agg.AddReader(strings.NewReader("Paris;12.3\nLima;1.0\n" + line + "\nRome;2.0\n"))
+		if !errors.As(err, &perr) || perr.Line != 3 || perr.Text != line || perr.Reason != "missing ';' or value" {
+			t.Errorf("%q: got %v", line, err)
+		}
+		agg.Close()
+	}
+}
+
+func TestDumpKeys(t *testing.T) {
+	names := genNames(300, 3, 20)
+	got := solveArgs(t, string(genMeasurements(100_000, names)), "-dump-keys")
+	if want := strings.Join(slices.Sorted(slices.Values(names)), "\n") + "\n"; got != want {
+		t.Errorf("got %d bytes of names, want %d", len(got), len(want))
+	}
+	if got := solveArgs(t, "Paris;1.0\nOslo;2.0\nParis;3.0\n", "-dump-keys", "-exclude", "Oslo"); got != "Paris\n" {
+		t.Errorf("with -exclude got %q", got)
+	}
+}
+
+func TestRounding(t *testing.T) {
+	// the means 2.25, -2.25 and 2.2666...
+	input := "A;2.2\nA;2.3\nB;-2.2\nB;-2.3\nC;2.2\nC;2.3\nC;2.3\n"
+	for mode, means := range map[string][3]string{
+		"half-away": {"2.3", "-2.3", "2.3"},
+		"half-up":   {"2.3", "-2.2", "2.3"},
+		"half-even": {"2.2", "-2.2", "2.3"},
+		"truncate":  {"2.2", "-2.2", "2.2"},
+	} {
+		want := fmt.Sprintf("A=2.2/%s/2.3\nB=-2.3/%s/-2.2\nC=2.2/%s/2.3\n", means[0], means[1], means[2])
+		if got := solveArgs(t, input, "-rounding", mode); got != want {
+			t.Errorf("-rounding %s: got %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	stdout, stderr, code := run1brc(t, "", "-version")
+	if code != exitOK {
+		t.Fatalf("exit code %d, stderr %q", code, stderr)
+	}
+	for _, want := range []string{runtime.Version(), runtime.GOOS + "/" + runtime.GOARCH, "race:", fmt.Sprintf("min/max:  %T\n", temp(0))} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("%q is missing %q", stdout, want)
+		}
+	}
+}
+
+func TestOneByteReads(t *testing.T) {
+	// long names so that many reads go by without a newline, across more
+	// than one read buffer
+	input := append(genMeasurements(60_000, genNames(50, 60, 120)), "Paris;12.3"...)
+	if len(input) <= readBufferSize {
+		t.Fatalf("%d bytes fit a single read buffer", len(input))
+	}
+	for _, strict := range []bool{false, true} {
+		opts := defaultArgs()
+		opts.workers, opts.strict = 1, strict
+		want := summary(t, aggregate(t, opts, bytes.NewReader(input)))
+		if got := summary(t, aggregate(t, opts, iotest.OneByteReader(bytes.NewReader(input)))); got != want {
+			t.Errorf("-strict %v: the results of 1 byte reads differ from the ones of a single read", strict)
+		}
+	}
+}
+
+func TestHotStations(t *testing.T) {
+	names := genNames(2000, 3, 20)
+	for name, input := range map[string][]byte{
+		"skewed":  genSkewedMeasurements(500_000, names),
+		"uniform": genMeasurements(500_000, names),
+	} {
+		opts := defaultArgs()
+		opts.workers, opts.subworkers = 1, 2 // the means of one summation order
+		want := summary(t, aggregate(t, opts, bytes.NewReader(input)))
+		for _, hot := range []int{1, 8, maxHotStations} {
+			opts.hotStations = hot
+			if got := summary(t, aggregate(t, opts, bytes.NewReader(input))); got != want {
+				t.Errorf("%s: the results with -hot-stations %d differ from the ones without", name, hot)
+			}
+		}
+	}
+}
+
+func TestJSONMap(t *testing.T) {
+	type stats struct {
+		Min, Mean, Max float64
+		Count          int
+	}
+	input := "Paris;1.0\nParis;-3.5\nOslo;2.0\nSay \"hi\";3.0\nZürich;-0.5\nback\\slash;9.9\n"
+	got := solveArgs(t, input, "-format", "json-map", "-counts")
+	var m map[string]stats
+	if err := json.Unmarshal([]byte(got), &m); err != nil {
+		t.Fatalf("%v in %s", err, got)
+	}
+	want := map[string]stats{
+		"Oslo":       {2.0, 2.0, 2.0, 1},
+		"Paris":      {-3.5, -1.3, 1.0, 2},
+		`Say "hi"`:   {3.0, 3.0, 3.0, 1},
+		"Zürich":     {-0.5, -0.5, -0.5, 1},
+		`back\slash`: {9.9, 9.9, 9.9, 1},
+	}
+	if !maps.Equal(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+	// sorted by name
+	if i, j := strings.Index(got, `"Paris"`), strings.Index(got, `"Oslo"`); j > i {
+		t.Errorf("Oslo printed after Paris in %s", got)
+	}
+
+	if got := solveArgs(t, "", "-format", "json-map"); got != "{\n}\n" {
+		t.Errorf("no stations got %q", got)
+	}
+
+	_, stderr, code := run1brc(t, "", "-format", "parquet", writeInput(t, input))
+	if code != exitIOError || !strings.Contains(stderr, "-format parquet is not supported") {
+		t.Errorf("-format parquet: exit code %d, stderr %q", code, stderr)
+	}
+}
+
+func TestFailOnEmpty(t *testing.T) {
+	for _, tc := range []struct {
+		name, input string
+		args        []string
+	}{
+		{"empty", "", nil},
+		{"blank lines", "\n\n\n", nil},
+		{"only a header", "station;temp\n", []string{"-header"}},
+		{"strict order", "", []string{"-strict-order"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"-quiet", "-fail-on-empty"}, tc.args...)
+			stdout, stderr, code := run1brc(t, "", append(args, writeInput(t, tc.input))...)
+			if code != exitIOError || stdout != "" || !strings.Contains(stderr, errEmptyInput.Error()) {
+				t.Errorf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+			}
+			// printing nothing without the flag
+			if got := solveArgs(t, tc.input, tc.args...); got != "" {
+				t.Errorf("without -fail-on-empty got %q", got)
+			}
+		})
+	}
+	if got := solveArgs(t, "Paris;12.3\n", "-fail-on-empty"); got != "Paris=12.3/12.3/12.3\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestNameArena(t *testing.T) {
+	// mostly first seen names, the arena blocks filled several times over
+	input := genMeasurements(200_000, genNames(150_000, 3, 40))
+	opts := defaultArgs()
+	opts.workers, opts.subworkers = 4, 2
+	want := extremes(t, aggregate(t, opts, bytes.NewReader(input)))
+	opts.nameArena = true
+	agg := aggregate(t, opts, bytes.NewReader(input))
+	// the names outlive the arenas, whatever reuses their memory next
+	aggregate(t, opts, bytes.NewReader(genMeasurements(200_000, genNames(150_000, 40, 40))))
+	if got := extremes(t, agg); got != want {
+		t.Error("the results with -name-arena differ from the ones without")
+	}
+}
+
+func TestMaxNameLen(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	long := strings.Repeat("x", 1<<20)
+	input := "Paris;12.3\n" + long + ";1.0\nOslo;-4.0\n" + "Berlin;2.0\n"
+	opts := defaultArgs()
+	opts.maxNameLen = 6 // Berlin is at the limit
+	if got := summary(t, aggregate(t, opts, strings.NewReader(input))); got != "Berlin=2.0/2.0/2.0 (1)\nOslo=-4.0/-4.0/-4.0 (1)\nParis=12.3/12.3/12.3 (1)\n" {
+		t.Errorf("got %q", got)
+	}
+	if want := `msg="skipping a station name longer than -max-name-len" bytes=1048576 name=xxxxxx... line=2`; !strings.Contains(logs.String(), want) {
+		t.Errorf("logged %q, want %q", logs.String(), want)
+	}
+
+	opts.strict = true
+	agg := newAggregator(opts)
+	defer agg.Close()
+	var perr *ParseError
+	if err := agg.AddReader(strings.NewReader(input)); !errors.As(err, &perr) || perr.Line != 2 || perr.Text != "xxxxxx..." {
+		t.Errorf("-strict: got %v", err)
+	}
+}
+
+func TestParallelRead(t *testing.T) {
+	// several read buffers, so the segment edges fall mid line
+	path := writeInput(t, string(genMeasurements(1_500_000, genNames(400, 3, 40))))
+	a := defaultArgs()
+	a.filename, a.filenames = path, []string{path}
+	a.workers = 4
+	solve := func() string {
+		agg, err := solve1brc(context.Background(), a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer agg.Close()
+		if rows := agg.Rows(); rows != 1_500_000 {
+			t.Errorf("-parallel-read %d: got %d rows", a.parallelRead, rows)
+		}
+		return extremes(t, agg)
+	}
+	want := solve()
+	for _, segments := range []int{2, 3, 8} {
+		a.parallelRead = segments
+		if got := solve(); got != want {
+			t.Errorf("the results with -parallel-read %d differ from the sequential ones", segments)
+		}
+	}
+}
+
+// A reader returning at most n bytes per Read, each after a pause.
+type throttledReader struct {
+	r     io.Reader
+	n     int
+	pause time.Duration
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	time.Sleep(t.pause)
+	return t.r.Read(b[:min(len(b), t.n)])
+}
+
+func TestWarnOnSlowRead(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	// about 100 KiB/s for longer than the window
+	input := genMeasurements(12_000, genNames(10, 3, 12))
+	opts := defaultArgs()
+	opts.warnOnSlowRead = 1
+	aggregate(t, opts, &throttledReader{r: bytes.NewReader(input), n: 1024, pause: 10 * time.Millisecond})
+	if want := "reading the input is slow, it is the bottleneck"; !strings.Contains(logs.String(), want) {
+		t.Errorf("logged %q, want %q", logs.String(), want)
+	}
+
+	logs.Reset()
+	aggregate(t, opts, bytes.NewReader(input))
+	if logs.Len() > 0 {
+		t.Errorf("a fast read logged %q", logs.String())
+	}
+}
+
+func TestCache(t *testing.T) {
+	input := writeInput(t, "Paris;12.3\n")
+	solve := func(args ...string) (string, string) {
+		t.Helper()
+		stdout, stderr, code := run1brc(t, "", append(append([]string{"-quiet", "-cache"}, args...), input)...)
+		if code != exitOK {
+			t.Fatalf("exit code %d, stderr %q", code, stderr)
+		}
+		return stdout, stderr
+	}
+	if stdout, stderr := solve(); stdout != "Paris=12.3/12.3/12.3\n" || strings.Contains(stderr, "cached") {
+		t.Errorf("first run: stdout %q, stderr %q", stdout, stderr)
+	}
+
+	// the marked sidecar is printed as is while the file is unchanged
+	b, err := os.ReadFile(cachePath(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cachePath(input), append(b, "# from the cache\n"...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if stdout, stderr := solve(); stdout != "Paris=12.3/12.3/12.3\n# from the cache\n" || !strings.Contains(stderr, "using the cached results") {
+		t.Errorf("second run: stdout %q, stderr %q", stdout, stderr)
+	}
+
+	// other flags or a new mtime solve again
+	if stdout, stderr := solve("-counts"); stdout != "Paris=12.3/12.3/12.3 (1)\n" || !strings.Contains(stderr, "stale") {
+		t.Errorf("other flags: stdout %q, stderr %q", stdout, stderr)
+	}
+	if err := os.WriteFile(input, []byte("Paris;12.4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(input, time.Time{}, info.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if stdout, stderr := solve(); stdout != "Paris=12.4/12.4/12.4\n" || !strings.Contains(stderr, "stale") {
+		t.Errorf("modified file: stdout %q, stderr %q", stdout, stderr)
+	}
+}
+
+func TestWorkerStopped(t *testing.T) {
+	input := genMeasurements(2_000_000, genNames(100, 3, 20)) // several chunks
+	for name, tc := range map[string]struct {
+		stop func()
+		want func(error) bool
+	}{
+		"panic": {func() { panic("worker") }, func(err error) bool {
+			var ierr *internalError
+			return errors.As(err, &ierr)
+		}},
+		"exit": {runtime.Goexit, func(err error) bool { return errors.Is(err, errWorkerStopped) }},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var once sync.Once
+			testHookChunk = func() { once.Do(tc.stop) }
+			defer func() { testHookChunk = nil }()
+
+			opts := defaultArgs()
+			opts.workers = 2
+			agg := newAggregator(opts)
+			defer agg.Close()
+			done := make(chan error)
+			go func() { done <- agg.AddReader(bytes.NewReader(input)) }()
+			select {
+			case err := <-done:
+				if !tc.want(err) {
+					t.Errorf("got %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the reader is still waiting on the stopped worker")
+			}
+		})
+	}
+}
+
+func TestRawInt(t *testing.T) {
+	input := string(genMeasurements(100_000, genNames(200, 3, 20))) + "Half;-2.2\nHalf;-2.3\n"
+	text := strings.Split(solveArgs(t, input, "-counts", "-workers", "1"), "\n")
+	raw := strings.Split(solveArgs(t, input, "-format", "raw-int", "-workers", "1"), "\n")
+	if len(raw) != len(text) || len(raw) < 200 {
+		t.Fatalf("got %d lines, want %d", len(raw), len(text))
+	}
+	for i, line := range text[:len(text)-1] {
+		var min, mean, max float64
+		var count int
+		eq := strings.LastIndexByte(line, '=')
+		if _, err := fmt.Sscanf(line[eq+1:], "%f/%f/%f (%d)", &min, &mean, &max, &count); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		// the printed values times 10
+		want := fmt.Sprintf("%s;%d;%d;%d;%d", line[:eq], int(math.Round(min*10)), int(math.Round(mean*10)), int(math.Round(max*10)), count)
+		if raw[i] != want {
+			t.Errorf("got %q, want %q", raw[i], want)
+		}
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	input := "\nParis;12.3\n\n\nOslo;-4.0\nParis;10.1\n\n"
+	if got := solveArgs(t, input, "-counts"); got != "Oslo=-4.0/-4.0/-4.0 (1)\nParis=10.1/11.2/12.3 (2)\n" {
+		t.Errorf("got %q", got)
+	}
+	for _, args := range [][]string{{"-skip-blank-lines=false"}, {"-strict"}} {
+		_, stderr, code := run1brc(t, "", append(append([]string{"-quiet"}, args...), writeInput(t, input))...)
+		if code != exitParseErr || !strings.Contains(stderr, "line 1") || !strings.Contains(stderr, "blank line") {
+			t.Errorf("%v: exit code %d, stderr %q", args, code, stderr)
+		}
+	}
+	// the line numbers still count the blank lines
+	_, stderr, code := run1brc(t, "", "-quiet", writeInput(t, "Paris;12.3\n\n\nOslo;\n"))
+	if code != exitParseErr || !strings.Contains(stderr, "line 4") {
+		t.Errorf("exit code %d, stderr %q", code, stderr)
+	}
+}
+
+func TestSetProgress(t *testing.T) {
+	// 8 byte lines, so every full read buffer ends on a line break and
+	// 2.5 buffers are 3 chunks
+	line := "abc;1.0\n"
+	input := strings.Repeat(line, 5*readBufferSize/2/len(line))
+	agg := newAggregator(defaultArgs())
+	defer agg.Close()
+	var got []Progress
+	agg.SetProgress(func(p Progress) { got = append(got, p) })
+	for range 2 {
+		if err := agg.AddReader(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 6 {
+		t.Fatalf("called %d times, want 6", len(got))
+	}
+	ends := []int64{readBufferSize, 2 * readBufferSize, int64(len(input))} // of the chunks of a reader
+	for i, p := range got {
+		bytes := int64(i/3)*int64(len(input)) + ends[i%3]
+		if p.Chunks != uint64(i+1) || p.Bytes != bytes || p.Rows > p.Bytes/int64(len(line)) {
+			t.Errorf("call %d: got %+v, want %d chunks of %d bytes", i, p, i+1, bytes)
+		}
+	}
+}
+
+func TestFlagConstant(t *testing.T) {
+	input := writeInput(t, "Stuck;5.0\nParis;12.3\nStuck;5.0\nOnce;1.0\nParis;10.0\nStuck;5.0\n")
+	stdout, stderr, code := run1brc(t, "", "-quiet", "-flag-constant", input)
+	if code != exitOK || stdout != "Once=1.0/1.0/1.0\nParis=10.0/11.2/12.3\nStuck=5.0/5.0/5.0\n" {
+		t.Fatalf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	// a single reading is not a stuck sensor
+	if want := `msg="station reports a constant value" station=Stuck value=5 count=3`; !strings.Contains(stderr, want) || strings.Contains(stderr, "station=Once") || strings.Contains(stderr, "station=Paris") {
+		t.Errorf("stderr %q, want %q", stderr, want)
+	}
+	if _, stderr, _ := run1brc(t, "", "-quiet", input); strings.Contains(stderr, "constant") {
+		t.Errorf("flagged without -flag-constant: %q", stderr)
+	}
+}
+
+func TestEmitSchema(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "# schema: station string, min decimal (celsius), mean decimal (celsius), max decimal (celsius)\n"},
+		{[]string{"-counts", "-units", "f"}, "# schema: station string, min decimal (fahrenheit), mean decimal (fahrenheit), max decimal (fahrenheit), count integer\n"},
+		{[]string{"-aggs", "range,count", "-provenance"}, "# schema: station string, range decimal (celsius), count decimal, first integer (row), last integer (row)\n"},
+	} {
+		got := solveArgs(t, "Paris;12.3\n", append([]string{"-emit-schema"}, tc.args...)...)
+		if schema, _, _ := strings.Cut(got, "\n"); schema+"\n" != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.args, schema, tc.want)
+		}
+	}
+
+	// every key of the stations described, and nothing else
+	got := solveArgs(t, "Paris;12.3\nOslo;1.0\n", "-emit-schema", "-format", "json-map", "-counts", "-percentiles", "p50,p99", "-bytes-per-station")
+	var m map[string]map[string]any
+	if err := json.Unmarshal([]byte(got), &m); err != nil {
+		t.Fatalf("%v in %s", err, got)
+	}
+	for _, name := range []string{"Paris", "Oslo"} {
+		if keys, schema := slices.Sorted(maps.Keys(m[name])), slices.Sorted(maps.Keys(m["_schema"])); !slices.Equal(keys, schema) {
+			t.Errorf("%s has %v, the schema %v", name, keys, schema)
+		}
+	}
+}
+
+func TestColumns(t *testing.T) {
+	input := "Paris;12.3\nParis;1.0\nOslo;2.0\n"
+	for columns, want := range map[string]string{
+		"mean,min,max,name": "2.0;2.0;2.0;Oslo\n6.7;1.0;12.3;Paris\n",
+		"name,max":          "Oslo;2.0\nParis;12.3\n",
+		"count,name,mean":   "1;Oslo;2.0\n2;Paris;6.7\n",
+	} {
+		if got := solveArgs(t, input, "-columns", columns, "-counts"); got != want {
+			t.Errorf("-columns %s: got %q, want %q", columns, got, want)
+		}
+	}
+	_, stderr, code := run1brc(t, "", "-quiet", "-columns", "name,median", writeInput(t, input))
+	if code != exitIOError || !strings.Contains(stderr, `unknown column "median"`) {
+		t.Errorf("exit code %d, stderr %q", code, stderr)
+	}
+}
+
+func TestNoCarryCopy(t *testing.T) {
+	// long lines, so most reads end within one and carry a lot of it over
+	input := append(genMeasurements(200_000, genNames(100, 200, 400)), "Paris;12.3"...)
+	readers := map[string]func() io.Reader{
+		"full":  func() io.Reader { return bytes.NewReader(input) },
+		"half":  func() io.Reader { return iotest.HalfReader(bytes.NewReader(input)) },
+		"eof":   func() io.Reader { return iotest.DataErrReader(bytes.NewReader(input)) },
+		"small": func() io.Reader { return &throttledReader{r: bytes.NewReader(input), n: 333} },
+	}
+	opts := defaultArgs()
+	opts.workers = 1 // the means of one summation order
+	want := summary(t, aggregate(t, opts, bytes.NewReader(input)))
+	opts.noCarryCopy = true
+	for name, r := range readers {
+		if got := summary(t, aggregate(t, opts, r())); got != want {
+			t.Errorf("%s reads: the results with -no-carry-copy differ from the ones without", name)
+		}
+	}
+}
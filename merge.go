@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse a line printed with -counts, <station>=<min>/<mean>/<max> (<count>).
+// The sum is recovered from the rounded mean, so means merged from these
+// lines can be off by the rounding of their inputs. Lines printed with -raw
+// carry the sum itself, see parseRawLine, and end in a digit instead of the
+// closing parenthesis of the count.
+func parseResultLine(line string) (string, *solutionItem, error) {
+	if !strings.HasSuffix(line, ")") && strings.Contains(line, ";") {
+		return parseRawLine(line)
+	}
+	eq := strings.LastIndexByte(line, '=')
+	if eq < 0 {
+		return "", nil, fmt.Errorf("missing '=' in result %q", line)
+	}
+	values, count, ok := strings.Cut(line[eq+1:], " (")
+	if !ok || !strings.HasSuffix(count, ")") {
+		return "", nil, fmt.Errorf("missing count in result %q, print results with -counts", line)
+	}
+	stats := strings.Split(values, "/")
+	if len(stats) != 3 {
+		return "", nil, fmt.Errorf("expected <min>/<mean>/<max> in result %q", line)
+	}
+
+	var v [3]float64
+	for i, stat := range stats {
+		f, err := strconv.ParseFloat(stat, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("bad value in result %q: %w", line, err)
+		}
+		v[i] = f
+	}
+	c, err := strconv.Atoi(strings.TrimSuffix(count, ")"))
+	if err != nil || c <= 0 {
+		return "", nil, fmt.Errorf("bad count in result %q", line)
+	}
+	return line[:eq], &solutionItem{min: temp(v[0]), max: temp(v[2]), acc: v[1] * float64(c), count: c}, nil
+}
+
+// Parse a line printed with -raw, <station>;<min>;<max>;<sum in tenths>;<count>.
+// The fields are split from the right, a name of -quoted can hold a ;.
+func parseRawLine(line string) (string, *solutionItem, error) {
+	fields := make([]string, 5)
+	rest := line
+	for i := len(fields) - 1; i > 0; i-- {
+		sc := strings.LastIndexByte(rest, ';')
+		if sc < 0 {
+			return "", nil, fmt.Errorf("expected <station>;<min>;<max>;<sum>;<count> in result %q", line)
+		}
+		rest, fields[i] = rest[:sc], rest[sc+1:]
+	}
+	fields[0] = rest
+	var v [2]float64
+	for i, field := range fields[1:3] {
+		f, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("bad value in result %q: %w", line, err)
+		}
+		v[i] = f
+	}
+	sum, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return "", nil, fmt.Errorf("bad sum in result %q: %w", line, err)
+	}
+	c, err := strconv.Atoi(fields[4])
+	if err != nil || c <= 0 {
+		return "", nil, fmt.Errorf("bad count in result %q", line)
+	}
+	return fields[0], &solutionItem{min: temp(v[0]), max: temp(v[1]), acc: float64(sum) / 10, count: c}, nil
+}
+
+// Merge result files printed with -counts or -raw into a single aggregator.
+// The files must hold Celsius results, the merged ones are printed in -units
+// as usual.
+func mergeResults(a args) (*Aggregator, error) {
+	agg := newAggregator(a)
+	for _, filename := range a.filenames {
+		f, err := openInput(filename)
+		if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if s.Text() == "" || strings.HasPrefix(s.Text(), "#") {
+				continue // e.g. the marker of partial results
+			}
+			name, item, err := parseResultLine(s.Text())
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			mergeItem(agg.solution, name, item)
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
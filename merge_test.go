@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseResultLine(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		name  string
+		item  solutionItem
+		fails bool
+	}{
+		{line: "Hamburg=-3.2/9.7/25.1 (3)", name: "Hamburg", item: solutionItem{min: -3.2, max: 25.1, acc: 9.7 * 3, count: 3}},
+		{line: "a=b=1.0/1.0/1.0 (1)", name: "a=b", item: solutionItem{min: 1, max: 1, acc: 1, count: 1}},
+		{line: "A;B=1.0/2.0/3.0 (2)", name: "A;B", item: solutionItem{min: 1, max: 3, acc: 4, count: 2}},
+		{line: "Hamburg;-3.2;25.1;291;3", name: "Hamburg", item: solutionItem{min: -3.2, max: 25.1, acc: 29.1, count: 3}},
+		{line: "A;B;1.0;3.0;40;2", name: "A;B", item: solutionItem{min: 1, max: 3, acc: 4, count: 2}},
+		{line: "Hamburg=-3.2/9.7/25.1", fails: true},
+		{line: "Hamburg=-3.2/25.1 (3)", fails: true},
+		{line: "Hamburg=-3.2/9.7/25.1 (0)", fails: true},
+		{line: "Hamburg;-3.2;291;3", fails: true},
+		{line: "Hamburg;-3.2;25.1;2.5;3", fails: true},
+		{line: "Hamburg;-3.2;25.1;291;0", fails: true},
+	} {
+		name, item, err := parseResultLine(tc.line)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%q: parsed as %q %+v, want an error", tc.line, name, *item)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.line, err)
+			continue
+		}
+		got, want := *item, tc.item
+		if name != tc.name || got.min != want.min || got.max != want.max || got.count != want.count || !closeTo(got.acc, want.acc, 1e-9) {
+			t.Errorf("%q: parsed as %q %+v, want %q %+v", tc.line, name, got, tc.name, want)
+		}
+	}
+}
+
+func closeTo(a, b, tolerance float64) bool {
+	return a-b <= tolerance && b-a <= tolerance
+}
+
+// Results printed with -raw merge back into the exact means, quoted names
+// holding a ; included.
+func TestRawRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	inputs := []string{"\"A;B\";1.0\nC;2.0\n\"A;B\";3.0\n", "C;2.5\n\"A;B\";0.5\nD;-1.0\n"}
+	var raws []string
+	for i, input := range inputs {
+		path := filepath.Join(dir, "m"+string(rune('0'+i))+".txt")
+		if err := os.WriteFile(path, []byte(input), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		stdout, stderr, code := run1brc(t, "", "-quiet", "-quoted", "-raw", path)
+		if code != exitOK {
+			t.Fatalf("exit code %d: %s", code, stderr)
+		}
+		raw := path + ".raw"
+		if err := os.WriteFile(raw, []byte(stdout), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		raws = append(raws, raw)
+	}
+	stdout, stderr, code := run1brc(t, "", append([]string{"-quiet", "-merge-only", "-counts"}, raws...)...)
+	if code != exitOK {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if want := "A;B=0.5/1.5/3.0 (3)\nC=2.0/2.3/2.5 (2)\nD=-1.0/-1.0/-1.0 (1)\n"; stdout != want {
+		t.Errorf("got\n%swant\n%s", stdout, want)
+	}
+}
+
+// Results printed with -counts merge into the results of their inputs solved
+// together.
+func TestMergeOnly(t *testing.T) {
+	inputs := []string{"Paris;12.3\nOslo;-4.0\nParis;14.1\n", "Paris;10.0\nRome;2.0\n"}
+	var results []string
+	for _, input := range inputs {
+		path := filepath.Join(t.TempDir(), "results.txt")
+		if err := os.WriteFile(path, []byte(solveArgs(t, input, "-counts")), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, path)
+	}
+	stdout, stderr, code := run1brc(t, "", append([]string{"-quiet", "-merge-only", "-counts"}, results...)...)
+	if code != exitOK {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if want := solveArgs(t, inputs[0]+inputs[1], "-counts"); stdout != want {
+		t.Errorf("got\n%swant\n%s", stdout, want)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+)
+
+// With -strict-order the input is expected sorted by station, so each station
+// is printed as soon as the next one starts and only one is ever held in
+// memory. The rows are read sequentially by a single parser, there is no
+// final map to merge. A station sorting before the previous one fails the
+// run: its rows might be split across the input, and it could not be printed
+// in order anyway.
+func solveStrictOrder(ctx context.Context, a args, w io.Writer) error {
+	readers := make([]io.Reader, 0, len(a.filenames))
+	for _, filename := range a.filenames {
+		f, err := openInput(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, _, err := inputReader(f, a.recordSep, a.compression)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+	}
+	r := bufio.NewReaderSize(io.MultiReader(readers...), readBufferSize)
+	if b, err := r.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		r.Discard(len(utf8BOM))
+	}
+	if a.header {
+		if _, err := r.ReadSlice(a.recordSep); err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil // only a header, nothing to print
+		}
+	}
+
+	if a.emitSchema {
+		printSchema(w, a)
+	}
+	p := newParser(a)
+	if a.sample < 1 {
+		p.smp = &sampler{p: a.sample, rng: rand.New(rand.NewPCG(a.seed, 0))}
+	}
+	agg := newAggregator(a) // only for the -units of the stats
+	dropped := 0
+	emit := func() {
+		for name, item := range p.solution {
+			if item.count == 0 {
+				continue
+			}
+			s := agg.newStationStats(name, item)
+			a.flagIfConstant(s)
+			if s.Count < a.minCount {
+				dropped++
+			} else if a.printStation(s) {
+				printStationLine(w, s, a, 0)
+			}
+		}
+		p.clearSolution()
+	}
+
+	var last []byte
+	started := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := r.ReadSlice(a.recordSep)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return fmt.Errorf("found a line longer than the %d byte read buffer on line %d", readBufferSize, p.lineBase+p.row)
+		}
+		if len(b) > 0 && b[len(b)-1] != a.recordSep {
+			b = append(bytes.Clone(b), a.recordSep) // unterminated last line
+		}
+		i := bytes.IndexByte(b, ';')
+		var name []byte
+		if i >= 0 {
+			name = b[:i]
+		}
+		if a.quoted && len(b) > 0 && b[0] == '"' {
+			name, i = unquoteName(b)
+		}
+		if i >= 0 {
+			if !started || !bytes.Equal(name, last) {
+				if started && bytes.Compare(name, last) < 0 {
+					return fmt.Errorf("-strict-order: station %q on line %d sorts before the previous station %q", name, p.lineBase+p.row, last)
+				}
+				emit()
+				last = append(last[:0], name...)
+				started = true
+			}
+		}
+		if len(b) > 0 {
+			p.processChunk(b, nil)
+			if p.err != nil {
+				return p.err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	emit()
+	if a.failOnEmpty && p.rows == 0 {
+		return errEmptyInput
+	}
+	if a.minCount > 0 {
+		slog.Info("dropped stations below -min-count", "stations", dropped, "min_count", a.minCount)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStrictOrder(t *testing.T) {
+	grouped := "Lima;20.0\nLima;21.0\nOslo;-1.0\nParis;12.3\nParis;14.1\nParis;9.0\n"
+	if got, want := solveArgs(t, grouped, "-strict-order"), solveArgs(t, grouped); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Lima comes back after Oslo
+	_, stderr, code := run1brc(t, "", "-quiet", "-strict-order", writeInput(t, "Lima;20.0\nOslo;-1.0\nLima;21.0\n"))
+	if code != exitIOError || !strings.Contains(stderr, `on line 3 sorts before the previous station`) {
+		t.Errorf("exit code %d, stderr %q", code, stderr)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+)
+
+// Readings sampled per station for -percentiles.
+const reservoirSize = 1000
+
+// A uniform sample of at most reservoirSize readings of a station, kept by
+// reservoir sampling so that memory is bounded by the sample size times the
+// number of stations however many readings each has. The percentiles are
+// computed from the sample, so they are exact up to reservoirSize readings
+// and estimates past it. The draws come from the generator of the parser,
+// seeded from -seed by chunk like -sample, and merges draw from their inputs,
+// so that identical runs print identical percentiles as long as the chunks go
+// to the same workers, always with -workers 1.
+type reservoir []temp
+
+// Offer the n-th reading of the station, counting from 1.
+func (r *reservoir) add(v temp, n int, rng *rand.Rand) {
+	if len(*r) < reservoirSize {
+		*r = append(*r, v)
+		return
+	}
+	if j := rng.IntN(n); j < reservoirSize {
+		(*r)[j] = v
+	}
+}
+
+// Merge the samples of rn and on readings into a single sample of at most
+// reservoirSize readings. Every slot is drawn from either side in proportion
+// to the readings its remaining samples stand for, the draws are seeded from
+// the counts and the first samples of both sides.
+func mergeReservoirs(r reservoir, rn int, o reservoir, on int) reservoir {
+	if len(r)+len(o) <= reservoirSize {
+		return append(r, o...)
+	}
+	rng := rand.New(rand.NewPCG(uint64(rn)<<32^uint64(on), math.Float64bits(float64(r[0]))^math.Float64bits(float64(o[0]))))
+	sides := [2]reservoir{slices.Clone(r), slices.Clone(o)}
+	per := [2]float64{float64(rn) / float64(len(r)), float64(on) / float64(len(o))}
+	weight := [2]float64{float64(rn), float64(on)}
+
+	merged := make(reservoir, 0, reservoirSize)
+	for len(merged) < reservoirSize {
+		k := 0
+		if len(sides[0]) == 0 || (len(sides[1]) > 0 && rng.Float64()*(weight[0]+weight[1]) >= weight[0]) {
+			k = 1
+		}
+		s := sides[k]
+		i := rng.IntN(len(s))
+		merged = append(merged, s[i])
+		s[i] = s[len(s)-1]
+		sides[k] = s[:len(s)-1]
+		weight[k] -= per[k]
+	}
+	return merged
+}
+
+// The nearest rank percentiles ps, within (0, 100], of the sample.
+func (r reservoir) percentiles(ps []float64) []float64 {
+	sorted := slices.Clone(r)
+	slices.Sort(sorted)
+	values := make([]float64, len(ps))
+	for i, p := range ps {
+		rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+		values[i] = float64(sorted[max(rank-1, 0)])
+	}
+	return values
+}
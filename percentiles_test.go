@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// The percentiles of a station with enough readings to sample them, merged
+// across workers.
+func samplePercentiles(t *testing.T, input []byte, seed uint64) []float64 {
+	t.Helper()
+	opts := defaultArgs()
+	opts.workers = 1
+	opts.seed = seed
+	opts.percentiles = []float64{50, 90, 99}
+	stats, err := aggregate(t, opts, bytes.NewReader(input)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats[0].Percentiles
+}
+
+func TestPercentilesSeeded(t *testing.T) {
+	input := genMeasurements(3<<20, []string{"Oslo"})
+	first := samplePercentiles(t, input, 1)
+	if again := samplePercentiles(t, input, 1); !slices.Equal(first, again) {
+		t.Errorf("got %v and %v from identical runs", first, again)
+	}
+	for seed := uint64(2); seed < 10; seed++ {
+		if other := samplePercentiles(t, input, seed); !slices.Equal(first, other) {
+			return
+		}
+	}
+	t.Errorf("got %v whatever the seed", first)
+}
+
+func TestTDigestTails(t *testing.T) {
+	// an exponential distribution, its readings thinning out to the right
+	rng := rand.New(rand.NewPCG(4, 0))
+	const n = 1_000_000
+	tenths := make([]int, n)
+	var input bytes.Buffer
+	for i := range tenths {
+		tenths[i] = min(999, int(rng.ExpFloat64()*100))
+		fmt.Fprintf(&input, "Oslo;%.1f\n", float64(tenths[i])/10)
+	}
+	slices.Sort(tenths)
+
+	opts := defaultArgs()
+	opts.workers = 4 // the digests of the workers merged
+	opts.percentiles = []float64{50, 99, 99.9}
+	opts.tdigest = true
+	stats, err := aggregate(t, opts, bytes.NewReader(input.Bytes())).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range opts.percentiles {
+		exact := float64(tenths[int(math.Ceil(p/100*n))-1]) / 10 // nearest rank
+		got := stats[0].Percentiles[i]
+		// the ranks of the estimate, all of the readings of its tenth, within
+		// 0.1% of the readings of p
+		v := int(math.Round(got * 10))
+		first, _ := slices.BinarySearch(tenths, v)
+		last, _ := slices.BinarySearch(tenths, v+1)
+		if float64(first)/n > p/100+0.001 || float64(last)/n < p/100-0.001 || math.Abs(got-exact) > 0.5 {
+			t.Errorf("p%v: got %.2f at the ranks %.4f-%.4f, exact %.1f", p, got, float64(first)/n, float64(last)/n, exact)
+		}
+	}
+}
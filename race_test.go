@@ -0,0 +1,7 @@
+//go:build race
+
+package main
+
+// The race detector drops a random share of what is put into a sync.Pool,
+// so the tests of the buffer reuse cannot count the allocations.
+const raceEnabled = true
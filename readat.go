@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// With -parallel-read a regular file is split into segments read with ReadAt,
+// each by its own reader and workers, so the reading itself runs in parallel
+// instead of behind a single loop. Every segment but the first starts right
+// after the first record separator past its share of the file, so no line is
+// split between two of them. The lines are counted within each segment, so
+// the options reporting line numbers cannot run with it.
+
+// Split the file into n segments on record boundaries. The last segment is
+// terminated like terminatedReader does for the whole file.
+func segmentReaders(f *os.File, n int, sep byte) ([]io.Reader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	starts := []int64{0}
+	for i := 1; i < n; i++ {
+		start, err := nextRecord(f, max(int64(i)*size/int64(n), starts[len(starts)-1]), size, sep)
+		if err != nil {
+			return nil, err
+		}
+		if start > starts[len(starts)-1] && start < size {
+			starts = append(starts, start)
+		}
+	}
+
+	readers := make([]io.Reader, len(starts))
+	for i, start := range starts {
+		end := size
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		readers[i] = io.NewSectionReader(f, start, end-start)
+	}
+	last, err := terminatedReader(f, sep)
+	if err != nil {
+		return nil, err
+	}
+	if last != io.Reader(f) { // the file is missing its final separator
+		readers[len(readers)-1] = io.MultiReader(readers[len(readers)-1], bytes.NewReader([]byte{sep}))
+	}
+	return readers, nil
+}
+
+// The offset right after the first record separator at or after off, or the
+// size of the file if there is none.
+func nextRecord(f *os.File, off, size int64, sep byte) (int64, error) {
+	buf := make([]byte, 4096)
+	for off < size {
+		n, err := f.ReadAt(buf, off)
+		if i := bytes.IndexByte(buf[:n], sep); i >= 0 {
+			return off + int64(i) + 1, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		off += int64(n)
+	}
+	return size, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// With -shard-output the results are split into numbered files of
+// -shard-size lines each, part-0000.txt, part-0001.txt and so on, so that
+// concatenating them in order gives the single file output back. A shard is
+// only created once its first line is written.
+type shardWriter struct {
+	dir   string
+	size  int
+	bufSz int
+
+	shard int // index of the next shard
+	lines int // written to the current shard
+	f     *os.File
+	w     *bufio.Writer
+}
+
+func newShardWriter(a args) (*shardWriter, error) {
+	if err := os.MkdirAll(a.shardOutput, 0o755); err != nil {
+		return nil, err
+	}
+	return &shardWriter{dir: a.shardOutput, size: a.shardSize, bufSz: a.outputBufferSize}, nil
+}
+
+func (s *shardWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if s.f == nil || s.lines == s.size {
+			if err := s.next(); err != nil {
+				return written, err
+			}
+		}
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+			s.lines++
+		}
+		n, err := s.w.Write(line)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(line):]
+	}
+	return written, nil
+}
+
+// Close the current shard and open the next one.
+func (s *shardWriter) next() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("part-%04d.txt", s.shard)))
+	if err != nil {
+		return err
+	}
+	s.f, s.w = f, bufio.NewWriterSize(f, s.bufSz)
+	s.shard++
+	s.lines = 0
+	return nil
+}
+
+func (s *shardWriter) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	f := s.f
+	s.f = nil
+	if err := s.w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
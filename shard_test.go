@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShardOutput(t *testing.T) {
+	for stations, shards := range map[int]int{250: 3, 200: 2, 1: 1} {
+		t.Run(fmt.Sprintf("stations=%d", stations), func(t *testing.T) {
+			input := string(genMeasurements(10_000, genNames(stations, 3, 20)))
+			want := solveArgs(t, input)
+			dir := filepath.Join(t.TempDir(), "shards")
+			if got := solveArgs(t, input, "-shard-output", dir, "-shard-size", "100"); got != "" {
+				t.Errorf("printed %q to stdout", got)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != shards {
+				t.Fatalf("got %d shards, want %d", len(entries), shards)
+			}
+			var got strings.Builder
+			for i, e := range entries {
+				if name := fmt.Sprintf("part-%04d.txt", i); e.Name() != name {
+					t.Errorf("shard %d is %s, want %s", i, e.Name(), name)
+				}
+				b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if lines := strings.Count(string(b), "\n"); lines != min(100, stations-100*i) {
+					t.Errorf("%s holds %d stations", e.Name(), lines)
+				}
+				got.Write(b)
+			}
+			if got.String() != want {
+				t.Error("the shards do not add up to the single file output")
+			}
+		})
+	}
+}
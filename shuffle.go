@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+)
+
+// Solve the files, then solve their lines again in a random order and fail if
+// the two results differ. Min, max and count must match exactly; the mean may
+// be off by a tenth, as the float sums depend on the order of the readings
+// and can round either way at the boundaries. The row columns of -provenance
+// are positions, so they are not compared.
+func shuffleCheck(ctx context.Context, a args) error {
+	if a.sample < 1 {
+		return errors.New("-shuffle-check needs every row, it cannot run with -sample")
+	}
+	agg, err := solve1brc(ctx, a)
+	if agg != nil {
+		defer agg.Close()
+	}
+	if err != nil {
+		return err
+	}
+	want, err := agg.Result()
+	if err != nil {
+		return err
+	}
+
+	var lines [][]byte
+	for i, filename := range a.filenames {
+		b, err := readInput(filename, a)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			b = bytes.TrimPrefix(b, utf8BOM)
+			if a.header {
+				if _, rest, ok := bytes.Cut(b, []byte{a.recordSep}); ok {
+					b = rest
+				} else {
+					b = nil
+				}
+			}
+		}
+		for line := range bytes.SplitSeq(b, []byte{a.recordSep}) {
+			if len(line) > 0 {
+				lines = append(lines, line)
+			}
+		}
+	}
+	rng := rand.New(rand.NewPCG(a.seed, uint64(len(lines))))
+	rng.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+	shuffled := append(bytes.Join(lines, []byte{a.recordSep}), a.recordSep)
+
+	opts := a
+	opts.header = false
+	sagg := newAggregator(opts)
+	defer sagg.Close()
+	if err := sagg.AddReaderContext(ctx, bytes.NewReader(shuffled)); err != nil {
+		return err
+	}
+	got, err := sagg.Result()
+	if err != nil {
+		return err
+	}
+
+	if len(got) != len(want) {
+		return fmt.Errorf("shuffle check failed: %d stations in order, %d shuffled", len(want), len(got))
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if w.Name != g.Name || w.Min != g.Min || w.Max != g.Max || w.Count != g.Count || math.Abs(w.Mean-g.Mean) > 0.1+1e-9 {
+			return fmt.Errorf("shuffle check failed: %v (%d) in order, %v (%d) shuffled", w, w.Count, g, g.Count)
+		}
+	}
+	slog.Info("shuffle check passed", "stations", len(want), "rows", len(lines), "seed", a.seed)
+	return nil
+}
+
+// The whole file as the pipeline reads it, decompressed or decoded from
+// UTF-16 if needed.
+func readInput(filename string, a args) ([]byte, error) {
+	f, err := openInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, _, err := inputReader(f, a.recordSep, a.compression)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
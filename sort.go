@@ -0,0 +1,77 @@
+package main
+
+import (
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// Below this many stations -parallel-sort sorts sequentially, the goroutines
+// and the merge buffer cost more than they save.
+const parallelSortThreshold = 1 << 16
+
+// Sort the station names, in parallel with -parallel-sort on large key sets.
+func sortKeys(keys []string, parallel bool) {
+	if !parallel || len(keys) < parallelSortThreshold || runtime.NumCPU() < 2 {
+		slices.Sort(keys)
+		return
+	}
+	parallelSort(keys, runtime.NumCPU())
+}
+
+// A merge sort over parts goroutines: each sorts its own run of keys, then
+// the runs are merged pairwise, every pair of a round concurrently, until a
+// single run is left. The result equals slices.Sort's, the keys are unique.
+func parallelSort(keys []string, parts int) {
+	bounds := make([]int, 0, parts+1)
+	for i := range parts {
+		bounds = append(bounds, i*len(keys)/parts)
+	}
+	bounds = append(bounds, len(keys))
+
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Go(func() { slices.Sort(keys[bounds[i]:bounds[i+1]]) })
+	}
+	wg.Wait()
+
+	src, dst := keys, make([]string, len(keys))
+	swapped := false
+	for len(bounds) > 2 {
+		next := make([]int, 0, len(bounds)/2+1)
+		for i := 0; i+1 < len(bounds); i += 2 {
+			lo := bounds[i]
+			next = append(next, lo)
+			if i+2 >= len(bounds) { // an odd run out, carried to the next round
+				copy(dst[lo:], src[lo:])
+				continue
+			}
+			mid, hi := bounds[i+1], bounds[i+2]
+			wg.Go(func() { mergeSorted(dst[lo:hi], src[lo:mid], src[mid:hi]) })
+		}
+		wg.Wait()
+		bounds = append(next, len(keys))
+		src, dst = dst, src
+		swapped = !swapped
+	}
+	if swapped {
+		copy(keys, src)
+	}
+}
+
+// Merge the sorted a and b into dst, which holds both.
+func mergeSorted(dst, a, b []string) {
+	i, j, k := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		if b[j] < a[i] {
+			dst[k] = b[j]
+			j++
+		} else {
+			dst[k] = a[i]
+			i++
+		}
+		k++
+	}
+	k += copy(dst[k:], a[i:])
+	copy(dst[k:], b[j:])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParallelSort(t *testing.T) {
+	keys := genNames(1_000_000, 3, 20)
+	rand.New(rand.NewPCG(3, 0)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	want := slices.Sorted(slices.Values(keys))
+	for _, parts := range []int{2, 7, 16} {
+		got := slices.Clone(keys)
+		parallelSort(got, parts)
+		if !slices.Equal(got, want) {
+			t.Errorf("%d parts: not sorted", parts)
+		}
+	}
+}
+
+func TestVerifySorted(t *testing.T) {
+	names := genNames(parallelSortThreshold+1000, 3, 20)
+	opts := defaultArgs()
+	opts.verifySorted, opts.parallelSort = true, true
+	// the stations without readings are printed in between the others
+	opts.stations, opts.emitEmpty = []string{"a", "mmm", "zzzzz"}, true
+	agg := aggregate(t, opts, bytes.NewReader(genMeasurements(200_000, names)))
+	var b bytes.Buffer
+	if err := printSolutions(&b, agg, opts); err != nil {
+		t.Fatal(err)
+	}
+	var printed []string
+	for line := range strings.Lines(b.String()) {
+		name, _, _ := strings.Cut(line, "=")
+		printed = append(printed, name)
+	}
+	if !slices.IsSorted(printed) || len(printed) < 3 {
+		t.Errorf("printed %d stations out of order", len(printed))
+	}
+}
+
+// The sequential sort against the parallel one at millions of stations.
+func BenchmarkSortKeys(b *testing.B) {
+	for _, stations := range []int{100_000, 1_000_000, 4_000_000} {
+		b.Run(fmt.Sprintf("stations=%d", stations), func(b *testing.B) {
+			keys := genNames(stations, 3, 20)
+			sorted := make([]string, len(keys))
+			for _, parallel := range []bool{false, true} {
+				b.Run(fmt.Sprintf("parallel=%v", parallel), func(b *testing.B) {
+					for b.Loop() {
+						copy(sorted, keys)
+						if parallel {
+							parallelSort(sorted, runtime.NumCPU())
+						} else {
+							slices.Sort(sorted)
+						}
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+// A spill run is a file holding partial solutions sorted by station name, so
+// that any number of runs can be merged while holding a single item per run in
+// memory. Each record is
+//
+//	<uvarint name len><name><min><max><acc><varint count><varint first row><varint last row><varint bytes>
+//
+// with the float64 values stored as their little endian IEEE 754 bits.
+
+// Write the solution to a new run in dir and clear it.
+func spill(dir string, solution map[string]*solutionItem) (string, error) {
+	f, err := os.CreateTemp(dir, "run-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	keys := make([]string, 0, len(solution))
+	for k := range solution {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	w := bufio.NewWriter(f)
+	buf := make([]byte, 0, 4*binary.MaxVarintLen64+24)
+	for _, k := range keys {
+		item := solution[k]
+		buf = binary.AppendUvarint(buf[:0], uint64(len(k)))
+		if _, err := w.Write(buf); err != nil {
+			return "", err
+		}
+		if _, err := w.WriteString(k); err != nil {
+			return "", err
+		}
+		buf = binary.LittleEndian.AppendUint64(buf[:0], math.Float64bits(float64(item.min)))
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(float64(item.max)))
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(item.acc))
+		buf = binary.AppendVarint(buf, int64(item.count))
+		buf = binary.AppendVarint(buf, item.firstRow)
+		buf = binary.AppendVarint(buf, item.lastRow)
+		buf = binary.AppendVarint(buf, item.bytes)
+		if _, err := w.Write(buf); err != nil {
+			return "", err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	clear(solution)
+	return f.Name(), f.Close()
+}
+
+type spillRun struct {
+	f    *os.File
+	r    *bufio.Reader
+	name string
+	item solutionItem
+}
+
+// Read the next record of the run, returning io.EOF once it is exhausted.
+func (s *spillRun) next() error {
+	n, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return err // a clean io.EOF when the run is over
+	}
+	name := make([]byte, n)
+	var fixed [24]byte
+	if _, err := io.ReadFull(s.r, name); err != nil {
+		return noEOF(err)
+	}
+	if _, err := io.ReadFull(s.r, fixed[:]); err != nil {
+		return noEOF(err)
+	}
+	count, err := binary.ReadVarint(s.r)
+	if err != nil {
+		return noEOF(err)
+	}
+	firstRow, err := binary.ReadVarint(s.r)
+	if err != nil {
+		return noEOF(err)
+	}
+	lastRow, err := binary.ReadVarint(s.r)
+	if err != nil {
+		return noEOF(err)
+	}
+	size, err := binary.ReadVarint(s.r)
+	if err != nil {
+		return noEOF(err)
+	}
+
+	s.name = string(name)
+	s.item = solutionItem{
+		min:      temp(math.Float64frombits(binary.LittleEndian.Uint64(fixed[0:]))),
+		max:      temp(math.Float64frombits(binary.LittleEndian.Uint64(fixed[8:]))),
+		acc:      math.Float64frombits(binary.LittleEndian.Uint64(fixed[16:])),
+		count:    int(count),
+		firstRow: firstRow,
+		lastRow:  lastRow,
+		bytes:    size,
+	}
+	return nil
+}
+
+// A record cut short is a corrupt run, not the end of it.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// runHeap orders the runs by their current station name.
+type runHeap []*spillRun
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].name < h[j].name }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*spillRun)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// K-way merge of the runs calling fn for every station in alphabetical order.
+func mergeRuns(runs []string, fn func(name string, item *solutionItem)) error {
+	h := make(runHeap, 0, len(runs))
+	defer func() {
+		for _, s := range h {
+			s.f.Close()
+		}
+	}()
+	for _, run := range runs {
+		f, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		s := &spillRun{f: f, r: bufio.NewReader(f)}
+		if err := s.next(); err != nil {
+			f.Close()
+			if errors.Is(err, io.EOF) {
+				continue
+			}
+			return err
+		}
+		h = append(h, s)
+	}
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		name, item := h[0].name, h[0].item
+		if err := advance(&h); err != nil {
+			return err
+		}
+		for len(h) > 0 && h[0].name == name {
+			item.merge(&h[0].item)
+			if err := advance(&h); err != nil {
+				return err
+			}
+		}
+		fn(name, &item)
+	}
+	return nil
+}
+
+// Move the smallest run to its next record, dropping it when exhausted.
+func advance(h *runHeap) error {
+	s := (*h)[0]
+	err := s.next()
+	if errors.Is(err, io.EOF) {
+		s.f.Close()
+		heap.Pop(h)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Fix(h, 0)
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestSpill(t *testing.T) {
+	input := genMeasurements(1_000_000, genNames(2000, 3, 20))
+	opts := defaultArgs()
+	opts.workers = 4
+	want := extremes(t, aggregate(t, opts, bytes.NewReader(input)))
+
+	opts.spill = 100
+	agg := newAggregator(opts)
+	if err := agg.AddReader(bytes.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if len(agg.runs) == 0 {
+		t.Fatal("no runs spilled past 100 stations")
+	}
+	if got := extremes(t, agg); got != want {
+		t.Error("the spilled results differ from the ones in memory")
+	}
+	dir := agg.spillDir
+	if err := agg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the spill directory is left after Close: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// With -tdigest the percentiles are estimated from a merging t-digest per
+// station instead of a reservoir sample. The digest keeps the readings as
+// centroids, weighted means of neighbouring readings, which are allowed to
+// grow large around the median and must stay small in the tails, so the
+// extreme percentiles stay accurate however skewed the readings are. Its
+// size is bounded by the compression, about that many centroids once
+// compressed, whatever the number of readings.
+
+const defaultTDigestCompression = 100
+
+type centroid struct {
+	mean, weight float64
+}
+
+type tdigest struct {
+	compression float64
+	centroids   []centroid // sorted by mean once compressed
+	buffer      []float64  // readings not compressed in yet
+	weight      float64    // of the centroids
+	min, max    float64
+}
+
+func newTDigest(compression float64) *tdigest {
+	return &tdigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (d *tdigest) add(v float64) {
+	d.buffer = append(d.buffer, v)
+	d.min = min(d.min, v)
+	d.max = max(d.max, v)
+	if len(d.buffer) >= 5*int(d.compression) {
+		d.compress()
+	}
+}
+
+// Fold another digest in, as if its readings had been added to this one.
+func (d *tdigest) merge(o *tdigest) {
+	d.compress()
+	o.compress()
+	d.centroids = append(d.centroids, o.centroids...)
+	d.weight += o.weight
+	d.min = min(d.min, o.min)
+	d.max = max(d.max, o.max)
+	d.recompress()
+}
+
+func (d *tdigest) clone() *tdigest {
+	c := *d
+	c.centroids = slices.Clone(d.centroids)
+	c.buffer = slices.Clone(d.buffer)
+	return &c
+}
+
+// Fold the buffered readings into the centroids.
+func (d *tdigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	for _, v := range d.buffer {
+		d.centroids = append(d.centroids, centroid{mean: v, weight: 1})
+	}
+	d.weight += float64(len(d.buffer))
+	d.buffer = d.buffer[:0]
+	d.recompress()
+}
+
+// Merge neighbouring centroids as long as the merged one stays within the
+// size allowed at its quantile q, 4 n q (1 - q) / compression, largest at the
+// median and down to a single reading at the ends.
+func (d *tdigest) recompress() {
+	if len(d.centroids) < 2 {
+		return
+	}
+	slices.SortFunc(d.centroids, func(a, b centroid) int {
+		if a.mean < b.mean {
+			return -1
+		} else if a.mean > b.mean {
+			return 1
+		}
+		return 0
+	})
+	out := d.centroids[:1]
+	before := 0.0 // weight of the centroids before the last one of out
+	for _, c := range d.centroids[1:] {
+		cur := &out[len(out)-1]
+		merged := cur.weight + c.weight
+		q := (before + merged/2) / d.weight
+		if merged <= max(1, 4*d.weight*q*(1-q)/d.compression) {
+			cur.mean += (c.mean - cur.mean) * c.weight / merged
+			cur.weight = merged
+			continue
+		}
+		before += cur.weight
+		out = append(out, c)
+	}
+	d.centroids = out
+}
+
+// The percentiles ps, within (0, 100], of the readings. Within a centroid the
+// readings are taken as spread evenly between the midpoints to its
+// neighbours, a centroid of a single reading is that reading, so that few
+// readings give the same nearest rank percentiles as the reservoir.
+func (d *tdigest) percentiles(ps []float64) []float64 {
+	d.compress()
+	values := make([]float64, len(ps))
+	for i, p := range ps {
+		values[i] = d.quantile(p / 100)
+	}
+	return values
+}
+
+func (d *tdigest) quantile(q float64) float64 {
+	rank := q * d.weight
+	before := 0.0
+	for i, c := range d.centroids {
+		if rank > before+c.weight && i < len(d.centroids)-1 {
+			before += c.weight
+			continue
+		}
+		if c.weight == 1 {
+			return c.mean
+		}
+		lo, hi := d.min, d.max
+		if i > 0 {
+			lo = (d.centroids[i-1].mean + c.mean) / 2
+		}
+		if i < len(d.centroids)-1 {
+			hi = (c.mean + d.centroids[i+1].mean) / 2
+		}
+		pos := min((rank-before)/c.weight, 1) // within (0, 1]
+		if pos < 0.5 {
+			return c.mean - (c.mean-lo)*(1-2*pos)
+		}
+		return c.mean + (hi-c.mean)*(2*pos-1)
+	}
+	return math.NaN() // no readings
+}
@@ -0,0 +1,8 @@
+//go:build float32
+
+package main
+
+// temp is the type of the min and max readings kept per station, float32 with
+// the float32 build tag. One fractional digit within [-99.9, 99.9] survives
+// the round trip, the sums stay float64 as they need the precision.
+type temp = float32
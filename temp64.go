@@ -0,0 +1,7 @@
+//go:build !float32
+
+package main
+
+// temp is the type of the min and max readings kept per station. Build with
+// -tags float32 to halve them at high cardinality, the sums stay float64.
+type temp = float64
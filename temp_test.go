@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Every reading prints the same through a float32 as through a float64.
+func TestTempRoundTrip(t *testing.T) {
+	for tenths := -999; tenths <= 999; tenths++ {
+		v := float64(tenths) / 10
+		if got, want := fmt.Sprintf("%.1f", float32(v)), fmt.Sprintf("%.1f", v); got != want {
+			t.Errorf("float32 prints %s as %s", want, got)
+		}
+	}
+}
+
+// The same output with and without -tags float32, run the tests with both.
+func TestTempOutput(t *testing.T) {
+	var input strings.Builder
+	for tenths := -999; tenths <= 999; tenths++ {
+		fmt.Fprintf(&input, "s%d;%.1f\n", (tenths+999)%7, float64(tenths)/10)
+	}
+	opts := defaultArgs()
+	opts.workers = 1
+	var b bytes.Buffer
+	if err := printSolutions(&b, aggregate(t, opts, strings.NewReader(input.String())), opts); err != nil {
+		t.Fatal(err)
+	}
+	want := "s0=-99.9/-0.2/99.6\ns1=-99.8/-0.1/99.7\ns2=-99.7/0.0/99.8\ns3=-99.6/0.2/99.9\ns4=-99.5/-0.1/99.3\ns5=-99.4/0.0/99.4\ns6=-99.3/0.1/99.5\n"
+	if b.String() != want {
+		t.Errorf("%T temps: got %q, want %q", temp(0), b.String(), want)
+	}
+}
+
+// The stats of the API hold the tenths as float64 parses them, whatever temp is.
+func TestTempStats(t *testing.T) {
+	stats, err := aggregate(t, defaultArgs(), strings.NewReader("Paris;12.3\nParis;-4.1\n")).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := stats[0]; s.Min != -4.1 || s.Max != 12.3 {
+		t.Errorf("%T temps: got the min %v and max %v", temp(0), s.Min, s.Max)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Windows exports are often UTF-16 with a byte order mark. A regular file
+// starting with one is decoded to UTF-8 before the pipeline, every other file
+// is read as is. Streams cannot be peeked at without a copy, so they are
+// always taken as UTF-8.
+
+// The reader of an input file: decompressed with -compression, decoded if it
+// is UTF-16, and terminated by sep either way so files read back to back keep
+// their lines apart.
+func inputReader(f *os.File, sep byte, compression string) (r io.Reader, decoded bool, err error) {
+	if r, err := decompressReader(f, compression, sep); r != nil || err != nil {
+		return r, true, err
+	}
+	order, err := detectUTF16(f)
+	if err != nil {
+		return nil, false, err
+	}
+	if order == nil {
+		r, err := terminatedReader(f, sep)
+		return r, false, err
+	}
+	return &utf16Reader{r: f, order: order, sep: sep, raw: make([]byte, 0, readBufferSize)}, true, nil
+}
+
+// The byte order of the UTF-16 byte order mark the file starts with, nil if
+// it does not start with one.
+func detectUTF16(f *os.File) (binary.ByteOrder, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() < 2 {
+		return nil, nil
+	}
+	bom := make([]byte, 2)
+	if _, err := f.ReadAt(bom, 0); err != nil {
+		return nil, err
+	}
+	switch {
+	case bom[0] == 0xFF && bom[1] == 0xFE:
+		return binary.LittleEndian, nil
+	case bom[0] == 0xFE && bom[1] == 0xFF:
+		return binary.BigEndian, nil
+	}
+	return nil, nil
+}
+
+// Decode UTF-16 to UTF-8, dropping the byte order mark. Unpaired surrogates
+// and a trailing odd byte become U+FFFD, and an unterminated last line is
+// terminated.
+type utf16Reader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	sep   byte
+
+	raw     []byte // read but not decoded yet, at most an odd byte between reads
+	dec     []byte // decoded, reused across reads
+	out     []byte // the part of dec not returned yet
+	high    rune   // a high surrogate waiting for its pair, 0 if none
+	started bool   // past the byte order mark
+	wrote   bool   // anything decoded, and last is the last byte of it
+	last    byte
+	eof     bool
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.out) == 0 {
+		if u.eof {
+			return 0, io.EOF
+		}
+		if err := u.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, u.out)
+	u.out = u.out[n:]
+	return n, nil
+}
+
+// Read and decode the next piece of the input into out.
+func (u *utf16Reader) fill() error {
+	n, err := u.r.Read(u.raw[len(u.raw):cap(u.raw)])
+	u.raw = u.raw[:len(u.raw)+n]
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	out := u.dec[:0]
+	i := 0
+	for ; i+1 < len(u.raw); i += 2 {
+		c := rune(u.order.Uint16(u.raw[i:]))
+		if !u.started {
+			u.started = true
+			if c == 0xFEFF {
+				continue
+			}
+		}
+		switch {
+		case u.high != 0:
+			r := utf16.DecodeRune(u.high, c)
+			u.high = 0
+			if r == utf8.RuneError && utf16.IsSurrogate(c) {
+				// not a pair, the new surrogate might start one still
+				out = utf8.AppendRune(out, utf8.RuneError)
+				i -= 2
+				continue
+			}
+			if r == utf8.RuneError {
+				out = utf8.AppendRune(out, utf8.RuneError)
+				r = c
+			}
+			out = utf8.AppendRune(out, r)
+		case c >= 0xD800 && c < 0xDC00:
+			u.high = c
+		default:
+			out = utf8.AppendRune(out, c) // a lone low surrogate is U+FFFD too
+		}
+	}
+	u.raw = u.raw[:copy(u.raw, u.raw[i:])]
+
+	if errors.Is(err, io.EOF) {
+		u.eof = true
+		if u.high != 0 || len(u.raw) > 0 {
+			out = utf8.AppendRune(out, utf8.RuneError)
+		}
+		if len(out) > 0 {
+			u.wrote, u.last = true, out[len(out)-1]
+		}
+		if u.wrote && u.last != u.sep {
+			out = append(out, u.sep)
+		}
+	} else if len(out) > 0 {
+		u.wrote, u.last = true, out[len(out)-1]
+	}
+	u.dec, u.out = out, out
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// Write s as UTF-16 with a byte order mark to a file in a new directory.
+func writeUTF16(t *testing.T, s string, order binary.AppendByteOrder) string {
+	t.Helper()
+	b := order.AppendUint16(nil, 0xFEFF)
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = order.AppendUint16(b, c)
+	}
+	path := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUTF16Input(t *testing.T) {
+	for name, order := range map[string]binary.AppendByteOrder{"le": binary.LittleEndian, "be": binary.BigEndian} {
+		t.Run(name, func(t *testing.T) {
+			a := defaultArgs()
+			a.filename = writeUTF16(t, "Zürich;1.0\nKraków;-2.5\n😀;3.0\nZürich;2.0", order)
+			a.filenames = []string{a.filename}
+			agg, err := solve1brc(context.Background(), a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer agg.Close()
+			want := "Kraków=-2.5/-2.5/-2.5 (1)\nZürich=1.0/1.5/2.0 (2)\n😀=3.0/3.0/3.0 (1)\n"
+			if got := summary(t, agg); got != want {
+				t.Errorf("got\n%swant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestUTF16ShuffleCheck(t *testing.T) {
+	a := defaultArgs()
+	a.filename = writeUTF16(t, "Zürich;1.0\nKraków;-2.5\nZürich;2.0\nKraków;4.0\n", binary.LittleEndian)
+	a.filenames = []string{a.filename}
+	if err := shuffleCheck(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnpairedSurrogates(t *testing.T) {
+	b := binary.LittleEndian.AppendUint16(nil, 0xFEFF)
+	for _, c := range []uint16{'A', 0xD800, ';', '1', '.', '0', '\n'} {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	path := filepath.Join(t.TempDir(), "m.txt")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a := defaultArgs()
+	a.filename, a.filenames = path, []string{path}
+	agg, err := solve1brc(context.Background(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agg.Close()
+	if got, want := summary(t, agg), "A�=1.0/1.0/1.0 (1)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUTF16Peek(t *testing.T) {
+	a := defaultArgs()
+	a.filename = writeUTF16(t, "Zürich;1.0\n", binary.LittleEndian)
+	var b strings.Builder
+	if err := peek(a, 1, &b); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%-30s %5.1f\n", "Zürich", 1.0); b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	watchPollInterval  = 500 * time.Millisecond
+	watchDebounce      = 200 * time.Millisecond
+	watchFlushInterval = time.Second // default of -flush-interval
+)
+
+func sameFileState(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// Solve and print the file, then keep polling it and solve again every time
+// its size or modification time changes. Writes in quick succession are
+// coalesced by waiting until the file stops changing for the debounce period,
+// and snapshots are printed at most once per -flush-interval however often it
+// changes. Every snapshot is a full solve of the file as it was when read.
+// There is no fsnotify in the dependencies, so polling it is.
+func watch(ctx context.Context, a args, interval, debounce time.Duration) error {
+	last, err := os.Stat(a.filename)
+	if err != nil {
+		return err
+	}
+	if err := solveAndPrint(ctx, a); err != nil {
+		return err
+	}
+	flushed := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		info, err := os.Stat(a.filename)
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		if sameFileState(info, last) {
+			continue
+		}
+		for {
+			time.Sleep(debounce)
+			next, err := os.Stat(a.filename)
+			if err != nil || sameFileState(next, info) {
+				break
+			}
+			info = next
+		}
+		if wait := a.flushInterval - time.Since(flushed); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			if next, err := os.Stat(a.filename); err == nil {
+				info = next // the changes made while throttled are in too
+			}
+		}
+		last = info
+
+		if a.output == "" {
+			fmt.Println("---") // a file output is rewritten instead
+		}
+		if err := solveAndPrint(ctx, a); err != nil {
+			slog.Error(err.Error())
+		}
+		flushed = time.Now()
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Wait for the file to hold want, failing the test after a few seconds.
+func waitForFile(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(path)
+		if string(b) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, want %q", b, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	a := defaultArgs()
+	a.filename = writeInput(t, "Paris;12.3\n")
+	a.filenames = []string{a.filename}
+	a.output = filepath.Join(t.TempDir(), "results.txt")
+	a.flushInterval = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watch(ctx, a, 10*time.Millisecond, 5*time.Millisecond) }()
+
+	waitForFile(t, a.output, "Paris=12.3/12.3/12.3\n")
+	if err := os.WriteFile(a.filename, []byte("Paris;12.3\nOslo;-4.0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, a.output, "Oslo=-4.0/-4.0/-4.0\nParis=12.3/12.3/12.3\n")
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v once canceled", err)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	a := defaultArgs()
+	a.filename = writeInput(t, "Paris;12.3\n")
+	a.filenames = []string{a.filename}
+	a.flushInterval = 200 * time.Millisecond
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// every snapshot but the first starts with a --- line on stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(stdout *os.File) { os.Stdout = stdout }(os.Stdout)
+	os.Stdout = w
+	snapshots := make(chan []time.Time)
+	go func() {
+		var at []time.Time
+		lines := bufio.NewScanner(r)
+		for lines.Scan() {
+			if lines.Text() == "---" {
+				at = append(at, time.Now())
+			}
+		}
+		snapshots <- at
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- watch(ctx, a, 5*time.Millisecond, time.Millisecond) }()
+	f, err := os.OpenFile(a.filename, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for start := time.Now(); time.Since(start) < 1200*time.Millisecond; {
+		if _, err := f.WriteString("Oslo;-4.0\n"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v once canceled", err)
+	}
+	w.Close()
+	at := <-snapshots
+
+	// about one per interval however often the file changes
+	if len(at) < 3 || len(at) > 7 {
+		t.Errorf("got %d snapshots in 1.2s at a 200ms interval", len(at))
+	}
+	for i := 1; i < len(at); i++ {
+		if gap := at[i].Sub(at[i-1]); gap < 180*time.Millisecond {
+			t.Errorf("snapshot %d came %v after the previous one", i, gap)
+		}
+	}
+}